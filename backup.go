@@ -0,0 +1,95 @@
+package buntdb
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// BackupProgress is the progress of a backup. See Config.OnBackupProgress.
+type BackupProgress struct {
+	// Items is the number of items that were written.
+	Items int
+	// Total is the number of items in the backup.
+	Total int
+	// Bytes is the number of bytes that were written.
+	Bytes int64
+}
+
+// Backup writes a copy of the database to a writer, which can be opened as
+// a database file, or loaded with Load. The copy is of the data that was
+// committed when the backup began, which is written without blocking reads
+// or writes, and without being affected by a Shrink. The copy is encrypted
+// and compressed like the database file. The backup stops with the error of
+// the context once it's done. See Config.OnBackupProgress.
+func (db *DB) Backup(ctx context.Context, w io.Writer) error {
+	// the header and the items are read from the same version.
+	db.RLock()
+	view := db.currentView()
+	buf := db.writeHeaderTo(nil)
+	format := db.config.SnapshotFormat
+	onProgress := db.config.OnBackupProgress
+	db.RUnlock()
+	if view == nil {
+		return ErrDatabaseClosed
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	cw := &countWriter{w: w}
+	progress := BackupProgress{Total: view.keys.Len()}
+	ew := db.enc.writer(cw, newFileID(), view.seq)
+	err := saveView(ew, view, buf, format, db.zip,
+		func(items int) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if onProgress != nil {
+				progress.Items, progress.Bytes = items, cw.n
+				onProgress(progress)
+			}
+			return nil
+		})
+	if err != nil {
+		return err
+	}
+	return ew.Close()
+}
+
+// BackupTo writes a copy of the database to a file at the path, which is
+// replaced once the copy is complete and durable. See Backup.
+func (db *DB) BackupTo(path string) error {
+	tmpname := path + ".tmp"
+	f, err := os.Create(tmpname)
+	if err != nil {
+		return err
+	}
+	err = db.Backup(context.Background(), f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpname, path)
+	}
+	if err != nil {
+		_ = os.Remove(tmpname)
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// countWriter counts the bytes that are written to a writer.
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
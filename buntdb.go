@@ -1,15 +1,18 @@
 // Package buntdb implements a low-level in-memory key/value store in pure Go.
-// It persists to disk, is ACID compliant, and uses locking for multiple
-// readers and a single writer. Bunt is ideal for projects that need a
-// dependable database, and favor speed over data size.
+// It persists to disk, is ACID compliant, and uses locking for a single
+// writer while readers read from immutable versions of the data. Bunt is
+// ideal for projects that need a dependable database, and favor speed over
+// data size.
 package buntdb
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
-	"os"
+	"math"
 	"strconv"
 	"strings"
 	"sync"
@@ -23,7 +26,8 @@ import (
 
 var (
 	// ErrTxNotWritable is returned when performing a write operation on a
-	// read-only transaction.
+	// read-only transaction, or when beginning a read/write transaction on a
+	// replica.
 	ErrTxNotWritable = errors.New("tx not writable")
 
 	// ErrTxClosed is returned when committing or rolling back a transaction
@@ -51,30 +55,106 @@ var (
 	// ErrShrinkInProcess is returned when a shrink operation is in-process.
 	ErrShrinkInProcess = errors.New("shrink is in-process")
 
+	// ErrLocked is returned when opening a database file that is open in
+	// another process.
+	ErrLocked = errors.New("database is locked")
+
 	// ErrPersistenceActive is returned when post-loading data from an database
 	// not opened with Open(":memory:").
 	ErrPersistenceActive = errors.New("persistence active")
 
 	// ErrTxIterating is returned when Set or Delete are called while iterating.
 	ErrTxIterating = errors.New("tx is iterating")
+
+	// ErrInvalidSnapshotFormat is returned for an invalid SnapshotFormat value.
+	ErrInvalidSnapshotFormat = errors.New("invalid snapshot format")
+
+	// ErrChecksum is returned when a transaction in the database file does
+	// not match its checksum.
+	ErrChecksum = errors.New("checksum mismatch")
+
+	// ErrConditionFailed is returned when the condition of a conditional
+	// write, such as SetNX or CompareAndSwap, is not met.
+	ErrConditionFailed = errors.New("condition failed")
+
+	// ErrNotNumeric is returned when a numeric operation, such as IncrBy,
+	// is used on a value that is not a number.
+	ErrNotNumeric = errors.New("value is not numeric")
+
+	// ErrSlowSubscriber is returned by Subscription.Err when the subscription
+	// was closed because its buffer was full.
+	ErrSlowSubscriber = errors.New("slow subscriber")
+
+	// ErrConflict is returned when committing an optimistic transaction that
+	// read or wrote an item that was changed by another transaction after
+	// it began.
+	ErrConflict = errors.New("tx conflict")
+
+	// ErrEncryptionKey is returned when opening a database file, or loading
+	// data, that is encrypted with a key that was not provided.
+	ErrEncryptionKey = errors.New("missing encryption key")
+
+	// ErrUnknownCodec is returned when opening a database file, or loading
+	// data, that has values that were compressed with a codec that was not
+	// provided.
+	ErrUnknownCodec = errors.New("unknown compression codec")
+
+	// ErrUnknownFunc is returned when creating an index with the name of a
+	// function that is not known to the database.
+	ErrUnknownFunc = errors.New("unknown index function")
 )
 
 // DB represents a collection of key-value pairs that persist on disk.
 // Transactions are used for all forms of data access to the DB.
 type DB struct {
-	*sync.RWMutex                   // the gatekeeper for all fields
-	file          *os.File          // the underlying file
-	buf           []byte            // a buffer to write to
-	keys          *btree.BTree      // a tree of all item ordered by key
-	exps          *btree.BTree      // a tree of items ordered by expiration
-	idxs          map[string]*index // the index trees.
-	insIdxs       []*index          // a reuse buffer for gathering indexes
-	flushes       int               // a count of the number of disk flushes
-	closed        bool              // set when the database has been closed
-	config        Config            // the database configuration
-	persist       bool              // do we write to disk
-	shrinking     bool              // when an aof shrink is in-process.
-	lastaofsz     int               // the size of the last shrink aof size
+	*sync.RWMutex                 // the gatekeeper for all fields
+	file          Storage         // the underlying file
+	buf           []byte          // a buffer to write to
+	enc           *encryption     // encrypts the file, may be nil
+	encbuf        []byte          // a buffer for encrypted records
+	encpos        encPos          // the last ENC record of the file
+	rekey         bool            // the file must be encrypted again
+	zip           *compression    // compresses values, may be nil
+	dbView                        // the live version of the database
+	flushes       int             // a count of the number of disk flushes
+	gsync         *groupSync      // the group commit for Always
+	submu         sync.Mutex      // guards subs and pending
+	subs          []*Subscription // the subscriptions
+	pending       []pendingEvents // events waiting for their commit's sync
+	unsynced      int             // bytes written since the last sync
+	unsyncedTxs   int             // commits written since the last sync
+	closed        bool            // set when the database has been closed
+	readonly      bool            // writable transactions are not allowed
+	tailpos       int64           // the end of the loaded part of the file
+	backlog       *backlog        // the commits that are sent to followers
+	replica       replicaState    // how far behind the primary a replica is
+	config        Config          // the database configuration
+	persist       bool            // do we write to disk
+	shrinking     bool            // when an aof shrink is in-process.
+	lastaofsz     int             // the size of the last shrink aof size
+	opts          Options         // the options provided to OpenWithOptions
+	report        RecoveryReport  // data lost while loading the file
+	nextexp       time.Time       // when the background manager wakes
+	bgwake        chan struct{}   // wakes the background manager early
+	loadrev       uint64          // the revision of the loading commit
+	vmu           sync.Mutex      // guards the fields below
+	view          *dbView         // the last published version
+	active        map[uint64]int  // optimistic transactions by version
+	commits       []*commitLog    // changes checked by optimistic txs
+}
+
+// dbView is a version of the database. A version is published by every
+// commit, and read-only transactions read from the version that was the
+// latest when they began. This allows for reading without waiting on the
+// writer. A published version is never changed.
+type dbView struct {
+	keys    *btree.BTree      // a tree of all item ordered by key
+	exps    *btree.BTree      // a tree of items ordered by expiration
+	idxs    map[string]*index // the index trees.
+	insIdxs []*index          // a reuse buffer for gathering indexes
+	seq     uint64            // the sequence of the last commit
+	ver     uint64            // the number of the version
+	refs    int               // pinned by transactions, guarded by vmu
 }
 
 // SyncPolicy represents how often data is synced to disk.
@@ -90,18 +170,37 @@ const (
 	// This is the recommended setting.
 	EverySecond = 1
 	// Always is used to sync data after every write to disk.
+	// Concurrent commits share a sync, but each one waits for it.
 	// Slow. Very safe.
 	Always = 2
+	// Periodic is used to sync data to disk every SyncInterval, or once
+	// SyncBytes or SyncCommits have been written since the last sync,
+	// whichever comes first. At least one of these must be set.
+	Periodic = 3
 )
 
 // Config represents database configuration options. These
 // options are used to change various behaviors of the database.
 type Config struct {
 	// SyncPolicy adjusts how often the data is synced to disk.
-	// This value can be Never, EverySecond, or Always.
+	// This value can be Never, EverySecond, Always, or Periodic.
 	// The default is EverySecond.
 	SyncPolicy SyncPolicy
 
+	// SyncInterval is how often data is synced to disk with the Periodic
+	// sync policy. Zero means that the data is not synced at an interval.
+	SyncInterval time.Duration
+
+	// SyncBytes is the number of bytes that are written to disk with the
+	// Periodic sync policy before the data is synced. Zero means that the
+	// number of bytes is not counted.
+	SyncBytes int
+
+	// SyncCommits is the number of commits that are written to disk with
+	// the Periodic sync policy before the data is synced. Zero means that the
+	// number of commits is not counted.
+	SyncCommits int
+
 	// AutoShrinkPercentage is used by the background process to trigger
 	// a shrink of the aof file when the size of the file is larger than the
 	// percentage of the result of the previous shrunk file.
@@ -117,6 +216,11 @@ type Config struct {
 	// AutoShrinkDisabled turns off automatic background shrinking
 	AutoShrinkDisabled bool
 
+	// SnapshotFormat is the format used by Shrink and Save for writing the
+	// items in the database. This value can be RESPSnapshot or
+	// BinarySnapshot. The default is RESPSnapshot.
+	SnapshotFormat SnapshotFormat
+
 	// OnExpired is used to custom handle the deletion option when a key
 	// has been expired.
 	OnExpired func(keys []string)
@@ -127,6 +231,114 @@ type Config struct {
 	// deletion of the timeed-out item is the explicit responsibility of this
 	// callback.
 	OnExpiredSync func(key, value string, tx *Tx) error
+
+	// BeforeCommit is called when a writable transaction that made changes
+	// is committed, before the changes are written to disk. The transaction
+	// can be used to read the database, and changes that are made with it
+	// are committed too. Returning an error rolls back the transaction and
+	// is returned by Commit. The database is locked while this is called,
+	// so it must not begin another transaction.
+	BeforeCommit func(tx *Tx, changes []Event) error
+
+	// OnCommit is called after a writable transaction that made changes has
+	// been committed, once the changes are as durable as the SyncPolicy
+	// makes them. It's called by the goroutine that committed.
+	OnCommit func(changes []Event)
+
+	// OnBackupProgress is called while Backup and BackupTo write a copy of
+	// the database, every few megabytes and once the copy is complete. It's
+	// called by the goroutine that is writing the copy.
+	OnBackupProgress func(progress BackupProgress)
+}
+
+// Options represents options that are provided when opening a database.
+// Unlike Config, these cannot be changed once the database is open.
+type Options struct {
+	// Comparators are custom less functions that may be used by persisted
+	// indexes. An index that is created by Tx.CreateIndexNamed with the map
+	// key of a function is written to the aof file with that name, which is
+	// used to resolve the function when the file is loaded again.
+	Comparators map[string]func(a, b string) bool
+
+	// Rects are custom rect functions that may be used by persisted spatial
+	// indexes. See Comparators and Tx.CreateSpatialIndexNamed.
+	Rects map[string]func(item string) (min, max []float64)
+
+	// Checksum writes every committed transaction with a CRC-32C checksum,
+	// which is verified when the database file is loaded. A transaction in
+	// the file that has no checksum is treated as corrupt, which includes
+	// the commits of a primary that does not write checksums.
+	Checksum bool
+
+	// Storage is where the append-only file is kept, instead of the file at
+	// the path that the database is opened with, which is then not used.
+	// The storage is closed when the database is closed. See
+	// NewMemoryStorage.
+	Storage Storage
+
+	// EncryptionKey encrypts the database file, and the data written by
+	// Save, with AES-GCM. The key must be 16, 24, or 32 bytes, which selects
+	// AES-128, AES-192, or AES-256. See DecryptionKeys.
+	EncryptionKey []byte
+
+	// DecryptionKeys are previous encryption keys, which are only used for
+	// loading data that was encrypted before the key was rotated. The file
+	// is shrunk when it's opened if any of its data is not encrypted with
+	// the EncryptionKey, which also encrypts a plain file, and decrypts the
+	// file when there is no EncryptionKey.
+	DecryptionKeys [][]byte
+
+	// Compression compresses the values that are at least
+	// CompressionThreshold bytes when they're written to the database file,
+	// and by Save. A database file that has compressed values can only be
+	// opened with the same codec. See NewDeflateCodec.
+	Compression Codec
+
+	// CompressionThreshold is the size of the smallest value that is
+	// compressed. The default is 1024.
+	CompressionThreshold int
+
+	// CompressInMemory keeps the compressed values compressed in memory
+	// too. This uses less memory, at the cost of decompressing a value every
+	// time that it's read, including by the less functions of indexes.
+	CompressInMemory bool
+
+	// SegmentSize splits the database file into segments of about this
+	// many bytes, which are kept in a directory at the path that the
+	// database is opened with. A Shrink only writes a new base snapshot of
+	// the segments, and deletes the previous base and segments. Zero means
+	// that the database file is a single file.
+	SegmentSize int64
+
+	// ReadOnly opens the database file without write access. Read/write
+	// transactions are not allowed, and the file is never truncated or
+	// shrunk. The file must exist. See OpenReadOnly.
+	ReadOnly bool
+
+	// TailInterval is how often a read-only database loads the records that
+	// another process appended to the file. Zero means that the file is only
+	// loaded again by Refresh.
+	TailInterval time.Duration
+
+	// Replica opens the database as a read-only follower of a primary
+	// database, which is kept up to date by Follow. See Replicate.
+	Replica bool
+
+	// ReplicationBacklog is the number of bytes of the latest commits that
+	// are kept for followers that fall behind or reconnect. A follower that
+	// needs older commits gets a full copy of the database instead. The
+	// default is 1MB.
+	ReplicationBacklog int
+
+	// SubscriptionBuffer is the number of events that are buffered for each
+	// subscription. The default is 1024. See Subscribe.
+	SubscriptionBuffer int
+
+	// Recovery is how corrupt data in the database file is handled when
+	// opening the database. This value can be RecoverRefuse,
+	// RecoverTruncate, or RecoverSkip. The default is RecoverRefuse.
+	// Use DB.RecoveryReport to learn about the data that was lost.
+	Recovery RecoveryMode
 }
 
 // exctx is a simple b-tree context for ordering by expiration.
@@ -137,7 +349,18 @@ type exctx struct {
 // Open opens a database at the provided path.
 // If the file does not exist then it will be created automatically.
 func Open(path string) (*DB, error) {
-	db := &DB{RWMutex: &sync.RWMutex{}}
+	return OpenWithOptions(path, Options{})
+}
+
+// OpenWithOptions opens a database at the provided path using the provided
+// options.
+// If the file does not exist then it will be created automatically.
+// The file is locked while the database is open, and ErrLocked is returned
+// when it's already open in another process. A read-only database does not
+// lock the file. The file is not locked on platforms other than Linux, macOS,
+// the BSDs and Windows.
+func OpenWithOptions(path string, opts Options) (*DB, error) {
+	db := &DB{RWMutex: &sync.RWMutex{}, opts: opts, gsync: newGroupSync()}
 	// initialize trees and indexes
 	db.keys = btreeNew(lessCtx(nil))
 	db.exps = btreeNew(lessCtx(&exctx{db}))
@@ -150,13 +373,32 @@ func Open(path string) (*DB, error) {
 	}
 	// turn off persistence for pure in-memory
 	db.persist = path != ":memory:"
-	if db.persist {
-		var err error
-		// hardcoding 0666 as the default mode.
-		db.file, err = os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0666)
+	db.readonly = opts.Replica || opts.ReadOnly
+	db.zip = newCompression(opts)
+	db.file = opts.Storage
+	if db.file == nil && db.persist && opts.SegmentSize > 0 {
+		ss, err := openSegmentedStorage(path, opts.SegmentSize, opts.ReadOnly)
+		if err != nil {
+			return nil, err
+		}
+		db.file = ss
+	} else if db.file == nil && db.persist {
+		fs, err := openFileStorage(path, opts.ReadOnly)
 		if err != nil {
 			return nil, err
 		}
+		db.file = fs
+	}
+	db.persist = db.file != nil
+	var err error
+	if db.enc, err = newEncryption(opts.EncryptionKey,
+		opts.DecryptionKeys); err != nil {
+		if db.persist {
+			_ = db.file.Close()
+		}
+		return nil, err
+	}
+	if db.persist {
 		// load the database from disk
 		if err := db.load(); err != nil {
 			// close on error, ignore close error
@@ -164,7 +406,17 @@ func Open(path string) (*DB, error) {
 			return nil, err
 		}
 	}
+	db.publish(nil)
+	if db.rekey && !opts.ReadOnly {
+		// rewrite the file with the encryption key.
+		if err := db.Shrink(); err != nil {
+			_ = db.file.Close()
+			return nil, err
+		}
+	}
 	// start the background manager.
+	db.bgwake = make(chan struct{}, 1)
+	db.nextexp = time.Now().Add(time.Second)
 	go db.backgroundManager()
 	return db, nil
 }
@@ -178,6 +430,14 @@ func (db *DB) Close() error {
 		return ErrDatabaseClosed
 	}
 	db.closed = true
+	db.closeSubscriptions()
+	if db.backlog != nil {
+		db.backlog.close()
+	}
+	db.vmu.Lock()
+	db.view = nil
+	db.vmu.Unlock()
+	db.wakeBackgroundManager()
 	if db.persist {
 		db.file.Sync() // do a sync but ignore the error (why?)
 		if err := db.file.Close(); err != nil {
@@ -190,21 +450,44 @@ func (db *DB) Close() error {
 	return nil
 }
 
-// Save writes a snapshot of the database to a writer. This operation blocks all
-// writes, but not reads. This can be used for snapshots and backups for pure
-// in-memory databases using the ":memory:". Database that persist to disk
-// can be snapshotted by simply copying the database file.
+// Save writes a snapshot of the database to a writer. This operation does not
+// block reads or writes. This can be used for snapshots and backups for pure
+// in-memory databases using the ":memory:". See Backup for databases that
+// persist to disk.
 func (db *DB) Save(wr io.Writer) error {
-	var err error
+	// the header and the items are read from the same version.
 	db.RLock()
-	defer db.RUnlock()
+	view := db.currentView()
+	buf := db.writeHeaderTo(nil)
+	format := db.config.SnapshotFormat
+	db.RUnlock()
+	if view == nil {
+		return ErrDatabaseClosed
+	}
+	w := db.enc.writer(wr, newFileID(), view.seq)
+	if err := saveView(w, view, buf, format, db.zip, nil); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// saveView writes a version of the database to a writer in a snapshot
+// format. The header records are written before the items. The step, when
+// not nil, is called with the number of items that were written after every
+// flush, and an error that it returns stops the writing.
+func saveView(wr io.Writer, view *dbView, buf []byte,
+	format SnapshotFormat, zip *compression, step func(items int) error) error {
+	var err error
+	if format == BinarySnapshot {
+		return saveSnapshot(wr, view, buf, zip, step)
+	}
 	// use a buffered writer and flush every 4MB
-	var buf []byte
-	now := time.Now()
 	// iterated through every item in the database and write to the buffer
-	btreeAscend(db.keys, func(item interface{}) bool {
+	var items int
+	btreeAscend(view.keys, func(item interface{}) bool {
 		dbi := item.(*dbItem)
-		buf = dbi.writeSetTo(buf, now)
+		buf = dbi.writeSetTo(buf, true, zip)
+		items++
 		if len(buf) > 1024*1024*4 {
 			// flush when buffer is over 4MB
 			_, err = wr.Write(buf)
@@ -212,8 +495,11 @@ func (db *DB) Save(wr io.Writer) error {
 				return false
 			}
 			buf = buf[:0]
+			if step != nil {
+				err = step(items)
+			}
 		}
-		return true
+		return err == nil
 	})
 	if err != nil {
 		return err
@@ -225,6 +511,9 @@ func (db *DB) Save(wr io.Writer) error {
 			return err
 		}
 	}
+	if step != nil {
+		return step(items)
+	}
 	return nil
 }
 
@@ -238,10 +527,52 @@ func (db *DB) Load(rd io.Reader) error {
 		// cannot load into databases that persist to disk
 		return ErrPersistenceActive
 	}
+	if db.readonly {
+		return ErrTxNotWritable
+	}
+	db.encpos = encPos{}
 	_, err := db.readLoad(rd, time.Now())
+	// the loaded items are visible even when the load failed part way.
+	db.publish([]*commitItem{{cmd: cmdFlushDB}})
+	if db.backlog != nil {
+		// the followers need a full copy of the database.
+		db.backlog.reset(db.seq)
+	}
 	return err
 }
 
+// saveSnapshot writes a version of the database to a writer in the binary
+// snapshot format. The header records are written before the items.
+func saveSnapshot(wr io.Writer, view *dbView, header []byte,
+	zip *compression, step func(items int) error) error {
+	var err error
+	var items int
+	sw := newSnapshotWriter(wr, zip)
+	sw.writeCommands(header)
+	btreeAscend(view.keys, func(item interface{}) bool {
+		sw.writeItem(item.(*dbItem))
+		items++
+		if len(sw.buf) > 1024*1024*4 {
+			// flush when buffer is over 4MB
+			err = sw.flush()
+			if err == nil && step != nil {
+				err = step(items)
+			}
+		}
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := sw.close(); err != nil {
+		return err
+	}
+	if step != nil {
+		return step(items)
+	}
+	return nil
+}
+
 // index represents a b-tree or r-tree index and also acts as the
 // b-tree/r-tree context for itself.
 type index struct {
@@ -253,6 +584,11 @@ type index struct {
 	rect    func(item string) (min, max []float64) // rect from string function
 	db      *DB                                    // the origin database
 	opts    IndexOptions                           // index options
+	funcs   []string                               // names of the functions
+	persist bool                                   // write to the aof file
+	shared  bool                                   // rtr is in a view
+	vtrs    []versionRTree                         // rtrees of versions
+	vops    []rtreeOp                              // changes since vtrs
 }
 
 // match matches the pattern to the key
@@ -281,6 +617,8 @@ func (idx *index) clearCopy() *index {
 		less:    idx.less,
 		rect:    idx.rect,
 		opts:    idx.opts,
+		funcs:   idx.funcs,
+		persist: idx.persist,
 	}
 	// initialize with empty trees
 	if nidx.less != nil {
@@ -292,6 +630,140 @@ func (idx *index) clearCopy() *index {
 	return nidx
 }
 
+// viewCopy creates a copy of the index for a version of the database. The
+// btree is copied lazily. The rtree is shared with the copy, and it's fully
+// copied by a copy that is changed, because it cannot be copied lazily like
+// a btree. See mutRTree and publishRTree.
+func (idx *index) viewCopy() *index {
+	nidx := *idx
+	nidx.vtrs, nidx.vops = nil, nil
+	if idx.btr != nil {
+		nidx.btr = idx.btr.Copy()
+	}
+	nidx.shared = idx.rtr != nil
+	return &nidx
+}
+
+// mutRTree returns the rtree of the index for making changes. An rtree that
+// is shared is fully copied first.
+func (idx *index) mutRTree() *rtred.RTree {
+	if idx.shared {
+		idx.rtr = copyRTree(idx, idx.rtr)
+		idx.shared = false
+	}
+	return idx.rtr
+}
+
+// copyRTree returns a copy of an rtree.
+func copyRTree(idx *index, tr *rtred.RTree) *rtred.RTree {
+	rtr := rtred.New(idx)
+	all := &rect{[]float64{math.Inf(-1)}, []float64{math.Inf(+1)}}
+	tr.Search(all, func(item rtred.Item) bool {
+		rtr.Insert(item)
+		return true
+	})
+	return rtr
+}
+
+// rtreeOp is a change to an rtree.
+type rtreeOp struct {
+	item   *dbItem
+	insert bool
+}
+
+// versionRTree is the rtree of a published version of the database.
+type versionRTree struct {
+	tr   *rtred.RTree
+	view *dbView // the version
+	pos  int     // the number of changes in vops that tr has
+}
+
+// insertRect inserts an item in to the rtree of the index.
+func (idx *index) insertRect(item *dbItem) {
+	idx.mutRTree().Insert(item)
+	idx.logRect(item, true)
+}
+
+// removeRect removes an item from the rtree of the index.
+func (idx *index) removeRect(item *dbItem) {
+	idx.mutRTree().Remove(item)
+	idx.logRect(item, false)
+}
+
+// logRect records a change to the rtree of the index, for making the same
+// change to the rtrees of the published versions. The change is not recorded
+// when the rtrees are going to be copied instead.
+func (idx *index) logRect(item *dbItem, insert bool) {
+	if idx.vtrs == nil {
+		return
+	}
+	if len(idx.vops) >= idx.db.keys.Len() {
+		// copying the rtree, which has no more items than the database,
+		// is cheaper than replaying the changes.
+		idx.vtrs, idx.vops = nil, nil
+		return
+	}
+	idx.vops = append(idx.vops, rtreeOp{item, insert})
+}
+
+// publishRTree returns the rtree for a new published version of the
+// database. The rtree of an earlier version that is not pinned by a
+// transaction is reused by making the changes to it that were made to the
+// index since, starting with the one that has the fewest changes to make.
+// The rtree of the index is copied when there is none. A version is never
+// pinned once it's replaced, so the changes are not seen by any transaction,
+// and the rtrees of the versions that are still pinned are kept for later.
+// The database view lock must be held.
+func (idx *index) publishRTree(view *dbView) *rtred.RTree {
+	end, limit := len(idx.vops), idx.db.keys.Len()
+	reuse := -1
+	for i, vt := range idx.vtrs {
+		if vt.view.refs == 0 && end-vt.pos < limit &&
+			(reuse == -1 || vt.pos > idx.vtrs[reuse].pos) {
+			reuse = i
+		}
+	}
+	var tr *rtred.RTree
+	if reuse == -1 {
+		tr = copyRTree(idx, idx.rtr)
+	} else {
+		tr = idx.vtrs[reuse].tr
+		for _, op := range idx.vops[idx.vtrs[reuse].pos:] {
+			if op.insert {
+				tr.Insert(op.item)
+			} else {
+				tr.Remove(op.item)
+			}
+		}
+	}
+	// the rtrees that are not pinned, or that are too far behind, are
+	// dropped.
+	vtrs := make([]versionRTree, 0, len(idx.vtrs)+1)
+	for i, vt := range idx.vtrs {
+		if i != reuse && vt.view.refs > 0 && end-vt.pos < limit {
+			vtrs = append(vtrs, vt)
+		}
+	}
+	vtrs = append(vtrs, versionRTree{tr: tr, view: view, pos: end})
+	// the changes that all of the kept rtrees have are dropped.
+	oldest := end
+	for _, vt := range vtrs {
+		if vt.pos < oldest {
+			oldest = vt.pos
+		}
+	}
+	for i := range vtrs {
+		vtrs[i].pos -= oldest
+	}
+	n := copy(idx.vops, idx.vops[oldest:])
+	for i := n; i < end; i++ {
+		idx.vops[i] = rtreeOp{}
+	}
+	idx.vops = idx.vops[:n]
+	idx.vtrs = vtrs
+	return tr
+}
+
 // rebuild rebuilds the index
 func (idx *index) rebuild() {
 	// initialize trees
@@ -300,6 +772,8 @@ func (idx *index) rebuild() {
 	}
 	if idx.rect != nil {
 		idx.rtr = rtred.New(idx)
+		idx.shared = false
+		idx.vtrs, idx.vops = nil, nil
 	}
 	// iterate through all keys and fill the index
 	btreeAscend(idx.db.keys, func(item interface{}) bool {
@@ -340,31 +814,152 @@ func (db *DB) SetConfig(config Config) error {
 	default:
 		return ErrInvalidSyncPolicy
 	case Never, EverySecond, Always:
+	case Periodic:
+		if config.SyncInterval == 0 && config.SyncBytes == 0 &&
+			config.SyncCommits == 0 {
+			return ErrInvalidSyncPolicy
+		}
+	}
+	if config.SyncInterval < 0 || config.SyncBytes < 0 ||
+		config.SyncCommits < 0 {
+		return ErrInvalidSyncPolicy
+	}
+	switch config.SnapshotFormat {
+	default:
+		return ErrInvalidSnapshotFormat
+	case RESPSnapshot, BinarySnapshot:
 	}
 	db.config = config
+	// the background manager schedules the next sync.
+	db.wakeBackgroundManager()
 	return nil
 }
 
+// copy returns a copy of the version. Copying the trees is cheap because a
+// copy shares its nodes with the original until either one is changed.
+func (v *dbView) copy() *dbView {
+	nv := &dbView{
+		keys: v.keys.Copy(),
+		exps: v.exps.Copy(),
+		idxs: make(map[string]*index, len(v.idxs)),
+		seq:  v.seq,
+		ver:  v.ver,
+	}
+	for name, idx := range v.idxs {
+		nv.idxs[name] = idx.viewCopy()
+	}
+	return nv
+}
+
+// publish makes the current state of the database the version that is read
+// by new transactions. The changes that were committed are kept for as long
+// as an optimistic transaction that began before them needs to check them.
+func (db *DB) publish(changes []*commitItem) {
+	view := db.dbView.copy()
+	db.vmu.Lock()
+	defer db.vmu.Unlock()
+	if db.view != nil {
+		view.ver = db.view.ver + 1
+	}
+	for name, idx := range view.idxs {
+		if idx.rtr != nil {
+			idx.rtr = db.idxs[name].publishRTree(view)
+		}
+	}
+	if len(db.active) > 0 && len(changes) > 0 {
+		db.commits = append(db.commits, newCommitLog(view.ver, changes))
+	}
+	db.view = view
+}
+
+// currentView returns the last published version of the database, or nil
+// when the database is closed.
+func (db *DB) currentView() *dbView {
+	db.vmu.Lock()
+	defer db.vmu.Unlock()
+	return db.view
+}
+
 // insertIntoDatabase performs inserts an item in to the database and updates
 // all indexes. If a previous item with the same key already exists, that item
 // will be replaced with the new one, and return the previous item.
 func (db *DB) insertIntoDatabase(item *dbItem) *dbItem {
+	return db.insertItem(item, false)
+}
+
+// loadIntoDatabase is the same as insertIntoDatabase but is optimized for
+// items that are loaded in ascending key order.
+func (db *DB) loadIntoDatabase(item *dbItem) *dbItem {
+	return db.insertItem(item, true)
+}
+
+// insertItem is called by insertIntoDatabase and loadIntoDatabase.
+func (db *DB) insertItem(item *dbItem, load bool) *dbItem {
+	pdbi := db.dbView.set(item, load)
+	if item.opts != nil && item.opts.ex && item.opts.exat.Before(db.nextexp) {
+		// The item expires before the background manager is
+		// scheduled to wake up.
+		db.wakeBackgroundManager()
+	}
+	return pdbi
+}
+
+// deleteFromDatabase removes and item from the database and indexes. The input
+// item must only have the key field specified thus "&dbItem{key: key}" is all
+// that is needed to fully remove the item with the matching key. If an item
+// with the matching key was found in the database, it will be removed and
+// returned to the caller. A nil return value means that the item was not
+// found in the database
+func (db *DB) deleteFromDatabase(item *dbItem) *dbItem {
+	return db.dbView.delete(item)
+}
+
+// clear removes all items and indexes, before the database is loaded again
+// from the start.
+func (db *DB) clear() {
+	db.dbView.reset(db)
+	db.idxs = make(map[string]*index)
+	db.seq = 0
+}
+
+// reset removes all items from the trees of the version, and re-creates the
+// indexes without any items.
+func (v *dbView) reset(db *DB) {
+	idxs := v.idxs
+	v.keys = btreeNew(lessCtx(nil))
+	v.exps = btreeNew(lessCtx(&exctx{db}))
+	v.idxs = make(map[string]*index)
+	for name, idx := range idxs {
+		v.idxs[name] = idx.clearCopy()
+	}
+}
+
+// set inserts an item in to the trees of the version and returns the previous
+// item with the same key. See insertItem.
+func (v *dbView) set(item *dbItem, load bool) *dbItem {
 	var pdbi *dbItem
 	// Generate a list of indexes that this item will be inserted in to.
-	idxs := db.insIdxs
-	for _, idx := range db.idxs {
+	idxs := v.insIdxs
+	for _, idx := range v.idxs {
 		if idx.match(item.key) {
 			idxs = append(idxs, idx)
 		}
 	}
-	prev := db.keys.Set(item)
+	var prev interface{}
+	if load {
+		// Load appends to the end of the tree when the item is greater
+		// than all other items, otherwise it falls back to a normal Set.
+		prev = v.keys.Load(item)
+	} else {
+		prev = v.keys.Set(item)
+	}
 	if prev != nil {
 		// A previous item was removed from the keys tree. Let's
 		// fully delete this item from all indexes.
 		pdbi = prev.(*dbItem)
 		if pdbi.opts != nil && pdbi.opts.ex {
 			// Remove it from the expires tree.
-			db.exps.Delete(pdbi)
+			v.exps.Delete(pdbi)
 		}
 		for _, idx := range idxs {
 			if idx.btr != nil {
@@ -373,14 +968,14 @@ func (db *DB) insertIntoDatabase(item *dbItem) *dbItem {
 			}
 			if idx.rtr != nil {
 				// Remove it from the rtree index.
-				idx.rtr.Remove(pdbi)
+				idx.removeRect(pdbi)
 			}
 		}
 	}
 	if item.opts != nil && item.opts.ex {
 		// The new item has eviction options. Add it to the
 		// expires tree
-		db.exps.Set(item)
+		v.exps.Set(item)
 	}
 	for i, idx := range idxs {
 		if idx.btr != nil {
@@ -389,33 +984,29 @@ func (db *DB) insertIntoDatabase(item *dbItem) *dbItem {
 		}
 		if idx.rtr != nil {
 			// Add new item to rtree index.
-			idx.rtr.Insert(item)
+			idx.insertRect(item)
 		}
 		// clear the index
 		idxs[i] = nil
 	}
 	// reuse the index list slice
-	db.insIdxs = idxs[:0]
+	v.insIdxs = idxs[:0]
 	// we must return the previous item to the caller.
 	return pdbi
 }
 
-// deleteFromDatabase removes and item from the database and indexes. The input
-// item must only have the key field specified thus "&dbItem{key: key}" is all
-// that is needed to fully remove the item with the matching key. If an item
-// with the matching key was found in the database, it will be removed and
-// returned to the caller. A nil return value means that the item was not
-// found in the database
-func (db *DB) deleteFromDatabase(item *dbItem) *dbItem {
+// delete removes an item from the trees of the version and returns it. See
+// deleteFromDatabase.
+func (v *dbView) delete(item *dbItem) *dbItem {
 	var pdbi *dbItem
-	prev := db.keys.Delete(item)
+	prev := v.keys.Delete(item)
 	if prev != nil {
 		pdbi = prev.(*dbItem)
 		if pdbi.opts != nil && pdbi.opts.ex {
 			// Remove it from the exipres tree.
-			db.exps.Delete(pdbi)
+			v.exps.Delete(pdbi)
 		}
-		for _, idx := range db.idxs {
+		for _, idx := range v.idxs {
 			if !idx.match(pdbi.key) {
 				continue
 			}
@@ -425,7 +1016,7 @@ func (db *DB) deleteFromDatabase(item *dbItem) *dbItem {
 			}
 			if idx.rtr != nil {
 				// Remove it from the rtree index.
-				idx.rtr.Remove(pdbi)
+				idx.removeRect(pdbi)
 			}
 		}
 	}
@@ -436,12 +1027,33 @@ func (db *DB) deleteFromDatabase(item *dbItem) *dbItem {
 // operations such as removing expired items and syncing to disk.
 func (db *DB) backgroundManager() {
 	flushes := 0
-	t := time.NewTicker(time.Second)
+	housekeeping := time.Now().Add(time.Second)
+	var syncat time.Time // the next sync of the Periodic sync policy
+	var tailat time.Time // the next load of a read-only database
+	t := time.NewTimer(time.Second)
 	defer t.Stop()
-	for range t.C {
-		var shrink bool
+	for {
+		select {
+		case <-t.C:
+		case <-db.bgwake:
+			if !t.Stop() {
+				select {
+				case <-t.C:
+				default:
+				}
+			}
+		}
+		// The sync and shrink checks happen once a second, while expired
+		// items are removed as soon as they expire. The Periodic sync policy
+		// syncs at its own interval.
+		now := time.Now()
+		chores := !now.Before(housekeeping)
+		if chores {
+			housekeeping = now.Add(time.Second)
+		}
 		// Open a standard view. This will take a full lock of the
 		// database thus allowing for access to anything we need.
+		// The expired items of a replica are deleted by its primary.
 		var onExpired func([]string)
 		var expired []*dbItem
 		var onExpiredSync func(key, value string, tx *Tx) error
@@ -450,24 +1062,21 @@ func (db *DB) backgroundManager() {
 			if onExpired == nil {
 				onExpiredSync = db.config.OnExpiredSync
 			}
-			if db.persist && !db.config.AutoShrinkDisabled {
-				pos, err := db.file.Seek(0, 1)
-				if err != nil {
-					return err
-				}
-				aofsz := int(pos)
-				if aofsz > db.config.AutoShrinkMinSize {
-					prc := float64(db.config.AutoShrinkPercentage) / 100.0
-					shrink = aofsz > db.lastaofsz+int(float64(db.lastaofsz)*prc)
-				}
-			}
 			// produce a list of expired items that need removing
-			btreeAscendLessThan(db.exps, &dbItem{
-				opts: &dbItemOpts{ex: true, exat: time.Now()},
-			}, func(item interface{}) bool {
+			pivot := &dbItem{opts: &dbItemOpts{ex: true, exat: time.Now()}}
+			btreeAscendLessThan(db.exps, pivot, func(item interface{}) bool {
 				expired = append(expired, item.(*dbItem))
 				return true
 			})
+			// schedule the next wake up for the earliest item that has
+			// not yet expired, or for the next housekeeping.
+			db.nextexp = housekeeping
+			btreeAscendGreaterOrEqual(db.exps, pivot, func(item interface{}) bool {
+				if exat := item.(*dbItem).opts.exat; exat.Before(db.nextexp) {
+					db.nextexp = exat
+				}
+				return false
+			})
 			if onExpired == nil && onExpiredSync == nil {
 				for _, itm := range expired {
 					if _, err := tx.Delete(itm.key); err != nil {
@@ -481,13 +1090,22 @@ func (db *DB) backgroundManager() {
 				}
 			} else if onExpiredSync != nil {
 				for _, itm := range expired {
-					if err := onExpiredSync(itm.key, itm.val, tx); err != nil {
+					if err := onExpiredSync(itm.key, db.value(itm),
+						tx); err != nil {
 						return err
 					}
 				}
 			}
 			return nil
 		})
+		if err == ErrTxNotWritable {
+			db.Lock()
+			if db.closed {
+				err = ErrDatabaseClosed
+			}
+			db.nextexp = housekeeping
+			db.Unlock()
+		}
 		if err == ErrDatabaseClosed {
 			break
 		}
@@ -502,13 +1120,39 @@ func (db *DB) backgroundManager() {
 		}
 
 		// execute a disk sync, if needed
+		var next time.Time
+		var shrink bool
 		func() {
 			db.Lock()
 			defer db.Unlock()
-			if db.persist && db.config.SyncPolicy == EverySecond &&
-				flushes != db.flushes {
+			if chores && db.persist && !db.opts.ReadOnly &&
+				!db.config.AutoShrinkDisabled {
+				if pos, err := db.file.Size(); err == nil &&
+					int(pos) > db.config.AutoShrinkMinSize {
+					aofsz := int(pos)
+					prc := float64(db.config.AutoShrinkPercentage) / 100.0
+					shrink = aofsz > db.lastaofsz+int(float64(db.lastaofsz)*prc)
+				}
+			}
+			dosync := chores && db.config.SyncPolicy == EverySecond
+			next = db.nextexp
+			if interval := db.config.SyncInterval; db.persist &&
+				db.config.SyncPolicy == Periodic && interval > 0 {
+				if !now.Before(syncat) {
+					dosync = true
+					syncat = now.Add(interval)
+				} else if syncat.After(now.Add(interval)) {
+					// the interval was shortened
+					syncat = now.Add(interval)
+				}
+				if syncat.Before(next) {
+					next = syncat
+				}
+			}
+			if dosync && db.persist && flushes != db.flushes {
 				_ = db.file.Sync()
 				flushes = db.flushes
+				db.unsynced, db.unsyncedTxs = 0, 0
 			}
 		}()
 		if shrink {
@@ -518,17 +1162,44 @@ func (db *DB) backgroundManager() {
 				}
 			}
 		}
+		// load what another process appended to a read-only database.
+		if interval := db.opts.TailInterval; db.opts.ReadOnly && interval > 0 {
+			if !now.Before(tailat) {
+				if err = db.Refresh(); err == ErrDatabaseClosed {
+					break
+				}
+				tailat = now.Add(interval)
+			}
+			if tailat.Before(next) {
+				next = tailat
+			}
+		}
+		t.Reset(time.Until(next))
+	}
+}
+
+// wakeBackgroundManager wakes the background manager, which removes expired
+// items and schedules its next wake up.
+func (db *DB) wakeBackgroundManager() {
+	select {
+	case db.bgwake <- struct{}{}:
+	default:
 	}
 }
 
 // Shrink will make the database file smaller by removing redundant
 // log entries. This operation does not block the database.
+// A read-only database cannot be shrunk.
 func (db *DB) Shrink() error {
 	db.Lock()
 	if db.closed {
 		db.Unlock()
 		return ErrDatabaseClosed
 	}
+	if db.opts.ReadOnly {
+		db.Unlock()
+		return ErrInvalidOperation
+	}
 	if !db.persist {
 		// The database was opened with ":memory:" as the path.
 		// There is no persistence, and no need to do anything here.
@@ -546,69 +1217,84 @@ func (db *DB) Shrink() error {
 		db.shrinking = false
 		db.Unlock()
 	}()
-	fname := db.file.Name()
-	tmpname := fname + ".tmp"
 	// the endpos is used to return to the end of the file when we are
 	// finished writing all of the current items.
-	endpos, err := db.file.Seek(0, 2)
+	endpos, err := db.file.Size()
 	if err != nil {
 		return err
 	}
+	// the index definitions and the current sequence are written at the top
+	// of the new file.
+	buf := db.writeHeaderTo(nil)
+	format := db.config.SnapshotFormat
+	// the items are read from the version that matches the end of the file.
+	view := db.currentView()
+	// the records that are kept from the end of the file belong to it.
+	file := db.fileID()
+	// the data up to the end of the file is replaced, while the records that
+	// are appended in the meantime are kept.
+	f, err := db.file.Replace(endpos)
 	db.Unlock()
-	time.Sleep(time.Second / 4) // wait just a bit before starting
-	f, err := os.Create(tmpname)
 	if err != nil {
 		return err
 	}
+	time.Sleep(time.Second / 4) // wait just a bit before starting
+
+	var replaced bool // the new file is the database file
 	defer func() {
-		_ = f.Close()
-		_ = os.RemoveAll(tmpname)
+		if !replaced {
+			_ = f.Abort()
+		}
 	}()
 
-	// we are going to read items in as chunks as to not hold up the database
-	// for too long.
-	var buf []byte
-	pivot := ""
-	done := false
-	for !done {
-		err := func() error {
-			db.RLock()
-			defer db.RUnlock()
-			if db.closed {
-				return ErrDatabaseClosed
-			}
-			done = true
-			var n int
-			now := time.Now()
-			btreeAscendGreaterOrEqual(db.keys, &dbItem{key: pivot},
-				func(item interface{}) bool {
-					dbi := item.(*dbItem)
-					// 1000 items or 64MB buffer
-					if n > 1000 || len(buf) > 64*1024*1024 {
-						pivot = dbi.key
-						done = false
-						return false
-					}
-					buf = dbi.writeSetTo(buf, now)
-					n++
-					return true
-				},
-			)
-			if len(buf) > 0 {
-				if _, err := f.Write(buf); err != nil {
-					return err
-				}
-				buf = buf[:0]
+	// the items are encrypted with the current key, which is how the key of
+	// the file is rotated. The records that are kept from the end of the
+	// file are encrypted with it already.
+	w := db.enc.writer(f, file, view.seq)
+	var sw *snapshotWriter
+	if format == BinarySnapshot {
+		sw = newSnapshotWriter(w, db.zip)
+		sw.writeCommands(buf)
+	}
+
+	// the items are read from an immutable version of the database, which
+	// does not hold up the database at all.
+	btreeAscend(view.keys, func(item interface{}) bool {
+		dbi := item.(*dbItem)
+		if sw != nil {
+			sw.writeItem(dbi)
+			if len(sw.buf) > 64*1024*1024 {
+				err = sw.flush()
 			}
-			return nil
-		}()
-		if err != nil {
+			return err == nil
+		}
+		buf = dbi.writeSetTo(buf, true, db.zip)
+		if len(buf) > 64*1024*1024 {
+			// flush when buffer is over 64MB
+			_, err = w.Write(buf)
+			buf = buf[:0]
+		}
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+	if sw != nil {
+		if err := sw.close(); err != nil {
+			return err
+		}
+	} else if len(buf) > 0 {
+		// one final flush
+		if _, err := w.Write(buf); err != nil {
 			return err
 		}
 	}
+	if err := w.Close(); err != nil {
+		return err
+	}
 	// We reached this far so all of the items have been written to a new tmp
-	// There's some more work to do by appending the new line from the aof
-	// to the tmp file and finally swap the files out.
+	// There's some more work to do by keeping the new lines from the aof
+	// and finally swapping the files out.
 	return func() error {
 		// We're wrapping this in a function to get the benefit of a defered
 		// lock/unlock.
@@ -617,41 +1303,15 @@ func (db *DB) Shrink() error {
 		if db.closed {
 			return ErrDatabaseClosed
 		}
-		// We are going to open a new version of the aof file so that we do
-		// not change the seek position of the previous. This may cause a
-		// problem in the future if we choose to use syscall file locking.
-		aof, err := os.Open(fname)
-		if err != nil {
-			return err
-		}
-		defer func() { _ = aof.Close() }()
-		if _, err := aof.Seek(endpos, 0); err != nil {
-			return err
-		}
-		// Just copy all of the new commands that have occurred since we
-		// started the shrink process.
-		if _, err := io.Copy(f, aof); err != nil {
+		// The storage keeps all of the new commands that have occurred
+		// since we started the shrink process. The new file is synced when
+		// it's committed, because commits that are waiting on a sync of the
+		// previous file may have been copied.
+		if err := f.Commit(); err != nil {
 			return err
 		}
-		// Close all files
-		if err := aof.Close(); err != nil {
-			return err
-		}
-		if err := f.Close(); err != nil {
-			return err
-		}
-		if err := db.file.Close(); err != nil {
-			return err
-		}
-		// Any failures below here are really bad. So just panic.
-		if err := os.Rename(tmpname, fname); err != nil {
-			log.Panic().Caller().Err(err).Msg("Shrink failed during os.Rename")
-		}
-		db.file, err = os.OpenFile(fname, os.O_CREATE|os.O_RDWR, 0666)
-		if err != nil {
-			log.Panic().Caller().Err(err).Msg("Shrink failed during os.OpenFile")
-		}
-		pos, err := db.file.Seek(0, 2)
+		replaced = true
+		pos, err := db.file.Size()
 		if err != nil {
 			return err
 		}
@@ -664,9 +1324,105 @@ func panicErr(err error) error {
 	panic(fmt.Errorf("buntdb: %w", err))
 }
 
+// commandReader reads RESP commands.
+type commandReader struct {
+	r     *bufio.Reader
+	data  []byte   // a buffer for reading parts
+	parts []string // the parts of the last command read
+	crc   uint32   // a running checksum of the raw bytes read
+}
+
+// readCommand reads a single command and returns the number of bytes read.
+// The parts of the command are stored in cr.parts.
+func (cr *commandReader) readCommand() (size int64, err error) {
+	r := cr.r
+	// first we should read the number of parts that the of the command
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return 0, err
+	}
+	if line[0] != '*' {
+		return 0, ErrInvalid
+	}
+	size += int64(len(line))
+	cr.crc = crc32.Update(cr.crc, crc32c, line)
+
+	// convert the string number to and int
+	var n int
+	if len(line) == 4 && line[len(line)-2] == '\r' {
+		if line[1] < '0' || line[1] > '9' {
+			return 0, ErrInvalid
+		}
+		n = int(line[1] - '0')
+	} else {
+		if len(line) < 5 || line[len(line)-2] != '\r' {
+			return 0, ErrInvalid
+		}
+		for i := 1; i < len(line)-2; i++ {
+			if line[i] < '0' || line[i] > '9' {
+				return 0, ErrInvalid
+			}
+			n = n*10 + int(line[i]-'0')
+		}
+	}
+	// read each part of the command.
+	cr.parts = cr.parts[:0]
+	for i := 0; i < n; i++ {
+		// read the number of bytes of the part.
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			return 0, err
+		}
+		if line[0] != '$' {
+			return 0, ErrInvalid
+		}
+		size += int64(len(line))
+		cr.crc = crc32.Update(cr.crc, crc32c, line)
+		// convert the string number to and int
+		var n int
+		if len(line) == 4 && line[len(line)-2] == '\r' {
+			if line[1] < '0' || line[1] > '9' {
+				return 0, ErrInvalid
+			}
+			n = int(line[1] - '0')
+		} else {
+			if len(line) < 5 || line[len(line)-2] != '\r' {
+				return 0, ErrInvalid
+			}
+			for i := 1; i < len(line)-2; i++ {
+				if line[i] < '0' || line[i] > '9' {
+					return 0, ErrInvalid
+				}
+				n = n*10 + int(line[i]-'0')
+			}
+		}
+		// resize the read buffer
+		if len(cr.data) < n+2 {
+			dataln := len(cr.data)
+			for dataln < n+2 {
+				dataln *= 2
+			}
+			cr.data = make([]byte, dataln)
+		}
+		if _, err = io.ReadFull(r, cr.data[:n+2]); err != nil {
+			return 0, err
+		}
+		if cr.data[n] != '\r' || cr.data[n+1] != '\n' {
+			return 0, ErrInvalid
+		}
+		cr.crc = crc32.Update(cr.crc, crc32c, cr.data[:n+2])
+		// copy string
+		cr.parts = append(cr.parts, string(cr.data[:n]))
+		size += int64(n + 2)
+	}
+	return size, nil
+}
+
 // readLoad reads from the reader and loads commands into the database.
 // modTime is the modified time of the reader, should be no greater than
 // the current time.Now().
+// Commands that are framed by BEGIN and COMMIT records are only loaded once
+// the COMMIT has been read, and its checksum, when present, has been verified.
 // Returns the number of bytes of the last command read and the error if any.
 func (db *DB) readLoad(rd io.Reader, modTime time.Time) (n int64, err error) {
 	defer func() {
@@ -675,22 +1431,59 @@ func (db *DB) readLoad(rd io.Reader, modTime time.Time) (n int64, err error) {
 		}
 	}()
 	totalSize := int64(0)
-	data := make([]byte, 4096)
-	parts := make([]string, 0, 8)
+	db.loadrev = 0
 	r := bufio.NewReader(rd)
+	if isEncrypted(r) {
+		// the records are read from the decrypted data, and the number of
+		// bytes read is the size of the ENC records in the file.
+		if db.enc == nil {
+			return 0, ErrEncryptionKey
+		}
+		er := newEncReader(db, r, db.encpos)
+		r = bufio.NewReader(er)
+		defer func() {
+			n = er.offset(n)
+			db.encpos = er.pos
+		}()
+	}
+	if hasSnapshot(r) {
+		// the data starts with a binary snapshot section.
+		n, err := db.readSnapshot(r)
+		if err != nil {
+			return totalSize, err
+		}
+		totalSize += n
+	}
+	cr := &commandReader{
+		r:     r,
+		data:  make([]byte, 4096),
+		parts: make([]string, 0, 8),
+	}
+	var inFrame bool       // reading a transaction
+	var frameSize int64    // the size of the transaction so far
+	var pending [][]string // the commands in the transaction
 	for {
 		// peek at the first byte. If it's a 'nul' control character then
 		// ignore it and move to the next byte.
 		c, err := r.ReadByte()
 		if err != nil {
 			if err == io.EOF {
-				err = nil
+				if inFrame {
+					// the transaction was never committed
+					err = io.ErrUnexpectedEOF
+				} else {
+					err = nil
+				}
 			}
 			return totalSize, err
 		}
 		if c == 0 {
 			// ignore nul control characters
-			n += 1
+			if inFrame {
+				frameSize++
+			} else {
+				totalSize++
+			}
 			continue
 		}
 		if err := r.UnreadByte(); err != nil {
@@ -698,136 +1491,181 @@ func (db *DB) readLoad(rd io.Reader, modTime time.Time) (n int64, err error) {
 		}
 
 		// read a single command.
-		// first we should read the number of parts that the of the command
-		cmdByteSize := int64(0)
-		line, err := r.ReadBytes('\n')
+		crc := cr.crc
+		cmdByteSize, err := cr.readCommand()
 		if err != nil {
 			return totalSize, err
 		}
-		if line[0] != '*' {
-			return totalSize, ErrInvalid
+		parts := cr.parts
+		if len(parts) == 0 {
+			continue
 		}
-		cmdByteSize += int64(len(line))
-
-		// convert the string number to and int
-		var n int
-		if len(line) == 4 && line[len(line)-2] == '\r' {
-			if line[1] < '0' || line[1] > '9' {
+		switch {
+		case isCommand(parts[0], "begin"):
+			// BEGIN
+			if inFrame || len(parts) != 1 {
 				return totalSize, ErrInvalid
 			}
-			n = int(line[1] - '0')
-		} else {
-			if len(line) < 5 || line[len(line)-2] != '\r' {
+			inFrame = true
+			frameSize = cmdByteSize
+			pending = pending[:0]
+			cr.crc = 0
+			continue
+		case isCommand(parts[0], "commit"):
+			// COMMIT, with an optional checksum of the framed commands.
+			if !inFrame || len(parts) > 2 {
 				return totalSize, ErrInvalid
 			}
-			for i := 1; i < len(line)-2; i++ {
-				if line[i] < '0' || line[i] > '9' {
-					return totalSize, ErrInvalid
-				}
-				n = n*10 + int(line[i]-'0')
-			}
-		}
-		// read each part of the command.
-		parts = parts[:0]
-		for i := 0; i < n; i++ {
-			// read the number of bytes of the part.
-			line, err := r.ReadBytes('\n')
-			if err != nil {
-				return totalSize, err
-			}
-			if line[0] != '$' {
-				return totalSize, ErrInvalid
+			if len(parts) == 1 && db.opts.Checksum {
+				return totalSize, ErrChecksum
 			}
-			cmdByteSize += int64(len(line))
-			// convert the string number to and int
-			var n int
-			if len(line) == 4 && line[len(line)-2] == '\r' {
-				if line[1] < '0' || line[1] > '9' {
+			if len(parts) == 2 {
+				sum, err := strconv.ParseUint(parts[1], 16, 32)
+				if err != nil {
 					return totalSize, ErrInvalid
 				}
-				n = int(line[1] - '0')
-			} else {
-				if len(line) < 5 || line[len(line)-2] != '\r' {
-					return totalSize, ErrInvalid
-				}
-				for i := 1; i < len(line)-2; i++ {
-					if line[i] < '0' || line[i] > '9' {
-						return totalSize, ErrInvalid
-					}
-					n = n*10 + int(line[i]-'0')
+				if uint32(sum) != crc {
+					return totalSize, ErrChecksum
 				}
 			}
-			// resize the read buffer
-			if len(data) < n+2 {
-				dataln := len(data)
-				for dataln < n+2 {
-					dataln *= 2
+			for _, parts := range pending {
+				if err := db.loadCommand(parts, modTime); err != nil {
+					return totalSize, err
 				}
-				data = make([]byte, dataln)
-			}
-			if _, err = io.ReadFull(r, data[:n+2]); err != nil {
-				return totalSize, err
-			}
-			if data[n] != '\r' || data[n+1] != '\n' {
-				return totalSize, ErrInvalid
 			}
-			// copy string
-			parts = append(parts, string(data[:n]))
-			cmdByteSize += int64(n + 2)
+			// the sequence only applies to the transaction that contains it.
+			db.loadrev = 0
+			totalSize += frameSize + cmdByteSize
+			inFrame = false
+			continue
 		}
-		// finished reading the command
-
-		if len(parts) == 0 {
+		if inFrame {
+			pending = append(pending, append([]string(nil), parts...))
+			frameSize += cmdByteSize
 			continue
 		}
-		if (parts[0][0] == 's' || parts[0][0] == 'S') &&
-			(parts[0][1] == 'e' || parts[0][1] == 'E') &&
-			(parts[0][2] == 't' || parts[0][2] == 'T') {
-			// SET
-			if len(parts) < 3 || len(parts) == 4 || len(parts) > 5 {
-				return totalSize, ErrInvalid
-			}
-			if len(parts) == 5 {
-				if strings.ToLower(parts[3]) != "ex" {
-					return totalSize, ErrInvalid
+		if err := db.loadCommand(parts, modTime); err != nil {
+			return totalSize, err
+		}
+		db.loadrev = 0
+		totalSize += cmdByteSize
+	}
+}
+
+// isCommand returns true if the command name matches cmd, ignoring case.
+func isCommand(name, cmd string) bool {
+	return len(name) == len(cmd) && strings.ToLower(name) == cmd
+}
+
+// loadCommand loads a single command into the database.
+func (db *DB) loadCommand(parts []string, modTime time.Time) error {
+	if (parts[0][0] == 's' || parts[0][0] == 'S') &&
+		(parts[0][1] == 'e' || parts[0][1] == 'E') &&
+		(parts[0][2] == 't' || parts[0][2] == 'T') {
+		// SET, with optional codec, expiration, and revision arguments.
+		if len(parts) < 3 || len(parts)%2 == 0 || len(parts) > 9 {
+			return ErrInvalid
+		}
+		item := &dbItem{key: parts[1], val: parts[2]}
+		var codec string
+		for i := 3; i < len(parts); i += 2 {
+			switch strings.ToLower(parts[i]) {
+			case "codec":
+				// the value is compressed
+				codec = parts[i+1]
+			case "pxat":
+				// absolute expiration in unix milliseconds
+				pxat, err := strconv.ParseInt(parts[i+1], 10, 64)
+				if err != nil {
+					return err
 				}
-				ex, err := strconv.ParseUint(parts[4], 10, 64)
+				item.opts = &dbItemOpts{ex: true, exat: time.Unix(pxat/1000,
+					(pxat%1000)*int64(time.Millisecond))}
+			case "ex":
+				// seconds relative to the time that the file was modified
+				ex, err := strconv.ParseUint(parts[i+1], 10, 64)
 				if err != nil {
-					return totalSize, err
+					return err
 				}
 				now := time.Now()
-				dur := (time.Duration(ex) * time.Second) - now.Sub(modTime)
-				if dur > 0 {
-					db.insertIntoDatabase(&dbItem{
-						key: parts[1],
-						val: parts[2],
-						opts: &dbItemOpts{
-							ex:   true,
-							exat: now.Add(dur),
-						},
-					})
+				item.opts = &dbItemOpts{ex: true, exat: now.Add(
+					(time.Duration(ex) * time.Second) - now.Sub(modTime))}
+			case "rev":
+				rev, err := strconv.ParseUint(parts[i+1], 10, 64)
+				if err != nil {
+					return err
 				}
-			} else {
-				db.insertIntoDatabase(&dbItem{key: parts[1], val: parts[2]})
+				item.rev = rev
+			default:
+				return ErrInvalid
 			}
-		} else if (parts[0][0] == 'd' || parts[0][0] == 'D') &&
-			(parts[0][1] == 'e' || parts[0][1] == 'E') &&
-			(parts[0][2] == 'l' || parts[0][2] == 'L') {
-			// DEL
-			if len(parts) != 2 {
-				return totalSize, ErrInvalid
+		}
+		if err := db.loadValue(item, codec); err != nil {
+			return err
+		}
+		if item.rev == 0 {
+			// The revision is the sequence of the transaction. Older files
+			// do not have sequences, so each item gets the next one.
+			if db.loadrev == 0 {
+				db.seq++
+				item.rev = db.seq
+			} else {
+				item.rev = db.loadrev
 			}
+		} else if item.rev > db.seq {
+			db.seq = item.rev
+		}
+		if item.opts != nil && !time.Now().Before(item.opts.exat) {
+			// the item has already expired, which also removes any
+			// previous item with the same key.
 			db.deleteFromDatabase(&dbItem{key: parts[1]})
-		} else if (parts[0][0] == 'f' || parts[0][0] == 'F') &&
-			strings.ToLower(parts[0]) == "flushdb" {
-			db.keys = btreeNew(lessCtx(nil))
-			db.exps = btreeNew(lessCtx(&exctx{db}))
-			db.idxs = make(map[string]*index)
 		} else {
-			return totalSize, ErrInvalid
+			db.insertIntoDatabase(item)
 		}
-		totalSize += cmdByteSize
+	} else if isCommand(parts[0], "seq") {
+		// SEQ
+		if len(parts) != 2 {
+			return ErrInvalid
+		}
+		seq, err := strconv.ParseUint(parts[1], 10, 64)
+		if err != nil {
+			return err
+		}
+		if seq > db.seq {
+			db.seq = seq
+		}
+		db.loadrev = seq
+	} else if (parts[0][0] == 'd' || parts[0][0] == 'D') &&
+		(parts[0][1] == 'e' || parts[0][1] == 'E') &&
+		(parts[0][2] == 'l' || parts[0][2] == 'L') {
+		// DEL
+		if len(parts) != 2 {
+			return ErrInvalid
+		}
+		db.deleteFromDatabase(&dbItem{key: parts[1]})
+	} else if (parts[0][0] == 'f' || parts[0][0] == 'F') &&
+		strings.ToLower(parts[0]) == "flushdb" {
+		// FLUSHDB, which keeps the index definitions just like DeleteAll
+		db.dbView.reset(db)
+	} else if cmd := strings.ToLower(parts[0]); cmd == "index" ||
+		cmd == "spatialindex" {
+		// INDEX and SPATIALINDEX
+		if len(parts) < 4 {
+			return ErrInvalid
+		}
+		funcs := append([]string(nil), parts[4:]...)
+		return db.loadIndex(cmd == "spatialindex", parts[1], parts[2],
+			parts[3], funcs)
+	} else if cmd == "dropindex" {
+		// DROPINDEX
+		if len(parts) != 2 {
+			return ErrInvalid
+		}
+		delete(db.idxs, parts[1])
+	} else {
+		return ErrInvalid
 	}
+	return nil
 }
 
 // load reads entries from the append only database file and fills the database.
@@ -835,27 +1673,26 @@ func (db *DB) readLoad(rd io.Reader, modTime time.Time) (n int64, err error) {
 // of RESP commands. For more information on RESP please read
 // http://redis.io/topics/protocol. The only supported RESP commands are DEL and
 // SET.
+// Corrupt data is handled according to the Recovery option and any data that
+// could not be loaded is described in the recovery report.
 func (db *DB) load() error {
-	fi, err := db.file.Stat()
+	size, err := db.file.Size()
 	if err != nil {
 		return err
 	}
-	n, err := db.readLoad(db.file, fi.ModTime())
-	if err != nil {
-		if err == io.ErrUnexpectedEOF {
-			// The db file has ended mid-command, which is allowed but the
-			// data file should be truncated to the end of the last valid
-			// command
-			if err := db.file.Truncate(n); err != nil {
-				return err
-			}
-		} else {
-			return err
+	if size > 0 && db.enc.encrypts() {
+		// a plain file is encrypted once it's loaded.
+		rec := make([]byte, len(encRecord))
+		if _, err := db.file.ReadAt(rec, 0); err != nil ||
+			string(rec) != encRecord {
+			db.rekey = true
 		}
 	}
-	if _, err := db.file.Seek(n, 0); err != nil {
+	size, err = db.loadFrom(0, size, storageModTime(db.file))
+	if err != nil {
 		return err
 	}
+	db.tailpos = size
 	var estaofsz int
 	db.keys.Walk(func(items []interface{}) {
 		for _, v := range items {
@@ -866,11 +1703,78 @@ func (db *DB) load() error {
 	return nil
 }
 
+// loadFrom loads the file from an offset and returns the offset that the
+// file was loaded up to. The file of a read-only database is never
+// truncated. Its loading stops where the file would have been truncated
+// instead, which may be a transaction that another process is writing.
+func (db *DB) loadFrom(off, size int64, modTime time.Time) (int64, error) {
+	if off == 0 {
+		// the ENC records are read from the start of the file.
+		db.encpos = encPos{}
+	}
+	for off < size {
+		n, err := db.readLoad(io.NewSectionReader(db.file, off, size-off),
+			modTime)
+		off += n
+		if err == nil {
+			break
+		}
+		lost := LostSection{Offset: off, Size: size - off, Err: err}
+		if err == io.ErrUnexpectedEOF {
+			// The db file has ended mid-command, which is allowed but the
+			// data file should be truncated to the end of the last valid
+			// command
+			if db.opts.ReadOnly {
+				return off, nil
+			}
+			lost.Truncated = true
+		} else if !errors.Is(err, ErrInvalid) && err != ErrChecksum {
+			return off, err
+		} else if db.opts.Recovery == RecoverTruncate {
+			lost.Truncated = true
+		} else if db.opts.Recovery == RecoverSkip {
+			// Skip to the start of the next transaction.
+			next, err := db.findFrame(off+1, size)
+			if err != nil {
+				return off, err
+			}
+			if next != -1 {
+				lost.Size = next - off
+				db.report.Lost = append(db.report.Lost, lost)
+				off = next
+				// the ENC records that were skipped are missing.
+				db.encpos.gap = true
+				continue
+			}
+			lost.Truncated = true
+		} else {
+			return off, err
+		}
+		if db.opts.ReadOnly {
+			// the same data is found again when the file is refreshed.
+			if n := len(db.report.Lost); n == 0 ||
+				db.report.Lost[n-1].Offset != off {
+				lost.Truncated = false
+				db.report.Lost = append(db.report.Lost, lost)
+			}
+			return off, nil
+		}
+		if err := db.file.Truncate(off); err != nil {
+			return off, err
+		}
+		db.report.Lost = append(db.report.Lost, lost)
+		size = off
+	}
+	return size, nil
+}
+
 // managed calls a block of code that is fully contained in a transaction.
-// This method is intended to be wrapped by Update and View
-func (db *DB) managed(writable bool, fn func(tx *Tx) error) (err error) {
+// This method is intended to be wrapped by Update, UpdateOptimistic and View,
+// and by their context variants. The ctx may be nil.
+func (db *DB) managed(ctx context.Context, writable, optimistic bool,
+	fn func(tx *Tx) error) (err error) {
 	var tx *Tx
-	tx, err = db.Begin(writable)
+	tx, err = db.begin(ctx, writable, optimistic)
 	if err != nil {
 		return
 	}
@@ -903,7 +1807,7 @@ func (db *DB) managed(writable bool, fn func(tx *Tx) error) (err error) {
 // Executing a manual commit or rollback from inside the function will result
 // in a panic.
 func (db *DB) View(fn func(tx *Tx) error) error {
-	return db.managed(false, fn)
+	return db.managed(nil, false, false, fn)
 }
 
 // Update executes a function within a managed read/write transaction.
@@ -915,18 +1819,44 @@ func (db *DB) View(fn func(tx *Tx) error) error {
 // Executing a manual commit or rollback from inside the function will result
 // in a panic.
 func (db *DB) Update(fn func(tx *Tx) error) error {
-	return db.managed(true, fn)
+	return db.managed(nil, true, false, fn)
 }
 
 // get return an item or nil if not found.
-func (db *DB) get(key string) *dbItem {
-	item := db.keys.Get(&dbItem{key: key})
+func (tx *Tx) get(key string) *dbItem {
+	tx.reads().addKey(key)
+	item := tx.trees().keys.Get(&dbItem{key: key})
 	if item != nil {
 		return item.(*dbItem)
 	}
 	return nil
 }
 
+// trees returns the version of the database that the transaction reads from.
+func (tx *Tx) trees() *dbView {
+	if tx.wc != nil && tx.wc.priv != nil {
+		// an optimistic transaction that has made changes.
+		return tx.wc.priv
+	} else if tx.view != nil {
+		return tx.view
+	}
+	return &tx.db.dbView
+}
+
+// reads returns what an optimistic transaction has read, or nil for other
+// transactions.
+func (tx *Tx) reads() *readSet {
+	if tx.wc == nil {
+		return nil
+	}
+	return tx.wc.reads
+}
+
+// optimistic returns true for an optimistic transaction.
+func (tx *Tx) optimistic() bool {
+	return tx.reads() != nil
+}
+
 // Tx represents a transaction on the database. This transaction can either be
 // read-only or read/write. Read-only transactions can be used for retrieving
 // values for keys and iterating through keys and values. Read/write
@@ -938,6 +1868,8 @@ type Tx struct {
 	writable bool            // when false mutable operations fail.
 	funcd    bool            // when true Commit and Rollback panic.
 	wc       *txWriteContext // context for writable transactions.
+	view     *dbView         // the version read when not locking the db.
+	ctx      context.Context // cancels waiting and scans, may be nil.
 }
 
 type txWriteContext struct {
@@ -947,9 +1879,58 @@ type txWriteContext struct {
 	rbidxs map[string]*index // the index trees.
 
 	rollbackItems   map[string]*dbItem // details for rolling back tx.
-	commitItems     map[string]*dbItem // details for committing tx.
+	commitItems     []*commitItem      // details for committing tx, in order.
+	seq             uint64             // the sequence of this commit
 	itercount       int                // stack of iterators
 	rollbackIndexes map[string]*index  // details for dropped indexes.
+
+	// optimistic transactions
+	reads *readSet // what the transaction has read and written
+	priv  *dbView  // the private trees that the changes are made to
+}
+
+// commitCmd is the kind of change made by a commitItem.
+type commitCmd byte
+
+const (
+	cmdSet       commitCmd = iota // the item was set
+	cmdDel                        // the key was deleted
+	cmdFlushDB                    // all items were deleted
+	cmdIndex                      // the index was created
+	cmdDropIndex                  // the index was dropped
+)
+
+// commitItem is a single change made by a transaction. The changes are
+// written to disk in the order that they were made.
+type commitItem struct {
+	cmd     commitCmd
+	key     string  // the key of the item or the name of the index
+	item    *dbItem // the item, for cmdSet
+	idx     *index  // the index, for cmdIndex
+	prev    *dbItem // the previous item, for cmdSet and cmdDel
+	expired bool    // the previous item had expired
+}
+
+// writeTo writes the change as a single record.
+func (ci *commitItem) writeTo(buf []byte, zip *compression) []byte {
+	switch ci.cmd {
+	case cmdSet:
+		return ci.item.writeSetTo(buf, false, zip)
+	case cmdDel:
+		return (&dbItem{key: ci.key}).writeDeleteTo(buf)
+	case cmdFlushDB:
+		return append(buf, "*1\r\n$7\r\nflushdb\r\n"...)
+	case cmdIndex:
+		return ci.idx.writeCreateTo(buf)
+	case cmdDropIndex:
+		return writeDropIndexTo(buf, ci.key)
+	}
+	return buf
+}
+
+// addCommit records a change that will be written to disk on commit.
+func (tx *Tx) addCommit(ci *commitItem) {
+	tx.wc.commitItems = append(tx.wc.commitItems, ci)
 }
 
 // DeleteAll deletes all items from the database.
@@ -962,26 +1943,33 @@ func (tx *Tx) DeleteAll() error {
 		return ErrTxIterating
 	}
 
-	// check to see if we've already deleted everything
-	if tx.wc.rbkeys == nil {
-		// we need to backup the live data in case of a rollback.
-		tx.wc.rbkeys = tx.db.keys
-		tx.wc.rbexps = tx.db.exps
-		tx.wc.rbidxs = tx.db.idxs
+	if tx.optimistic() {
+		// an optimistic transaction only resets its private trees, but it
+		// depends on every item in the database.
+		tx.wc.reads.all = true
+		tx.private().reset(tx.db)
+	} else {
+		// check to see if we've already deleted everything
+		if tx.wc.rbkeys == nil {
+			// we need to backup the live data in case of a rollback.
+			tx.wc.rbkeys = tx.db.keys
+			tx.wc.rbexps = tx.db.exps
+			tx.wc.rbidxs = tx.db.idxs
+		}
+		// now reset the live database trees
+		tx.db.dbView.reset(tx.db)
 	}
 
-	// now reset the live database trees
-	tx.db.keys = btreeNew(lessCtx(nil))
-	tx.db.exps = btreeNew(lessCtx(&exctx{tx.db}))
-	tx.db.idxs = make(map[string]*index)
-
-	// finally re-create the indexes
-	for name, idx := range tx.wc.rbidxs {
-		tx.db.idxs[name] = idx.clearCopy()
+	// the previous item changes no longer matter, but the index changes
+	// must be kept because the index definitions remain.
+	commits := tx.wc.commitItems[:0]
+	for _, ci := range tx.wc.commitItems {
+		if ci.cmd == cmdIndex || ci.cmd == cmdDropIndex {
+			commits = append(commits, ci)
+		}
 	}
-
-	// always clear out the commits
-	tx.wc.commitItems = make(map[string]*dbItem)
+	tx.wc.commitItems = commits
+	tx.addCommit(&commitItem{cmd: cmdFlushDB})
 
 	return nil
 }
@@ -991,17 +1979,27 @@ func (tx *Tx) DeleteAll() error {
 // only be one read/write transaction at a time. Attempting to open a read/write
 // transactions while another one is in progress will result in blocking until
 // the current read/write transaction is completed.
+// A read-only transaction never waits on a read/write transaction. It reads
+// the version of the database that was committed last before it began, and
+// does not see the changes of transactions that commit while it is open.
+// A replica only allows read-only transactions.
 //
 // All transactions must be closed by calling Commit() or Rollback() when done.
 func (db *DB) Begin(writable bool) (*Tx, error) {
+	return db.begin(nil, writable, false)
+}
+
+// begin opens a new transaction, which is an optimistic read/write
+// transaction when optimistic is true. The ctx may be nil.
+func (db *DB) begin(ctx context.Context, writable, optimistic bool) (*Tx,
+	error) {
+	if writable && db.readonly {
+		return nil, ErrTxNotWritable
+	}
 	tx := &Tx{
 		db:       db,
 		writable: writable,
-	}
-	tx.lock()
-	if db.closed {
-		tx.unlock()
-		return nil, ErrDatabaseClosed
+		ctx:      ctx,
 	}
 	if writable {
 		// writable transactions have a writeContext object that
@@ -1009,29 +2007,61 @@ func (db *DB) Begin(writable bool) (*Tx, error) {
 		tx.wc = &txWriteContext{}
 		tx.wc.rollbackItems = make(map[string]*dbItem)
 		tx.wc.rollbackIndexes = make(map[string]*index)
-		if db.persist {
-			tx.wc.commitItems = make(map[string]*dbItem)
+		if optimistic {
+			tx.wc.reads = newReadSet()
 		}
 	}
+	if err := tx.lock(); err != nil {
+		return nil, err
+	}
+	if writable {
+		// the sequence is only used when there are changes to commit.
+		tx.wc.seq = tx.trees().seq + 1
+	}
 	return tx, nil
 }
 
-// lock locks the database based on the transaction type.
-func (tx *Tx) lock() {
-	if tx.writable {
-		tx.db.Lock()
-	} else {
-		tx.db.RLock()
+// lock locks the database based on the transaction type. Only a writable
+// transaction that is not optimistic locks the database, the others pin the
+// current version. An error is returned when the database is closed or the
+// context of the transaction is done, and the database is not locked.
+func (tx *Tx) lock() error {
+	switch {
+	case tx.optimistic():
+		tx.view = tx.db.pin(true)
+	case tx.writable:
+		if err := tx.db.lockContext(tx.ctx); err != nil {
+			return err
+		}
+		if tx.db.closed {
+			tx.db.Unlock()
+			return ErrDatabaseClosed
+		}
+		return nil
+	default:
+		tx.view = tx.db.pin(false)
+	}
+	if tx.view == nil {
+		return ErrDatabaseClosed
 	}
+	return nil
 }
 
 // unlock unlocks the database based on the transaction type.
 func (tx *Tx) unlock() {
-	if tx.writable {
+	switch {
+	case tx.optimistic():
+		if tx.view != nil {
+			tx.db.unpin(tx.view, true)
+		}
+	case tx.writable:
 		tx.db.Unlock()
-	} else {
-		tx.db.RUnlock()
+	default:
+		if tx.view != nil {
+			tx.db.unpin(tx.view, false)
+		}
 	}
+	tx.view = nil
 }
 
 // rollbackInner handles the underlying rollback logic.
@@ -1075,37 +2105,68 @@ func (tx *Tx) Commit() error {
 	} else if !tx.writable {
 		return ErrTxNotWritable
 	}
+	if tx.optimistic() {
+		// The changes of an optimistic transaction are made to the database
+		// once it's known that they do not conflict.
+		if err := tx.apply(); err != nil {
+			tx.unlock()
+			tx.db = nil
+			return err
+		}
+	}
+	if before := tx.db.config.BeforeCommit; before != nil &&
+		len(tx.wc.commitItems) > 0 {
+		if err := before(tx, tx.db.events(tx.wc.seq,
+			tx.wc.commitItems)); err != nil {
+			tx.rollbackInner()
+			tx.unlock()
+			tx.db = nil
+			return err
+		}
+	}
 	var err error
-	if tx.db.persist && (len(tx.wc.commitItems) > 0 || tx.wc.rbkeys != nil) {
-		tx.db.buf = tx.db.buf[:0]
-		// write a flushdb if a deleteAll was called.
-		if tx.wc.rbkeys != nil {
-			tx.db.buf = append(tx.db.buf, "*1\r\n$7\r\nflushdb\r\n"...)
+	var changes []Event // the changes for OnCommit
+	onCommit := tx.db.config.OnCommit
+	var file Storage  // the file to sync
+	var ticket uint64 // the write that is synced
+	if (tx.db.persist || tx.db.backlog != nil) &&
+		len(tx.wc.commitItems) > 0 {
+		// The records are framed by BEGIN and COMMIT records, which ensures
+		// that a transaction that was only partially written to disk is
+		// never loaded.
+		tx.db.buf = appendBegin(tx.db.buf[:0])
+		start := len(tx.db.buf)
+		// The sequence of the commit is also the version of every item
+		// that is set by the transaction.
+		tx.db.buf = appendSeq(tx.db.buf, tx.wc.seq)
+		// Each committed record is written to disk in the same order that
+		// the changes were made.
+		for _, ci := range tx.wc.commitItems {
+			tx.db.buf = ci.writeTo(tx.db.buf, tx.db.zip)
 		}
-		now := time.Now()
-		// Each committed record is written to disk
-		for key, item := range tx.wc.commitItems {
-			if item == nil {
-				tx.db.buf = (&dbItem{key: key}).writeDeleteTo(tx.db.buf)
-			} else {
-				tx.db.buf = item.writeSetTo(tx.db.buf, now)
-			}
+		if tx.db.opts.Checksum {
+			crc := crc32.Checksum(tx.db.buf[start:], crc32c)
+			tx.db.buf = appendCommitChecksum(tx.db.buf, crc)
+		} else {
+			tx.db.buf = appendCommit(tx.db.buf)
 		}
+	}
+	if tx.db.persist && len(tx.wc.commitItems) > 0 {
 		// Flushing the buffer only once per transaction.
 		// If this operation fails then the write did failed and we must
 		// rollback.
 		var n int
-		n, err = tx.db.file.Write(tx.db.buf)
+		n, err = tx.db.file.Append(tx.db.encrypt(tx.db.buf, tx.wc.seq))
 		if err != nil {
 			if n > 0 {
 				// There was a partial write to disk.
 				// We are possibly out of disk space.
 				// Delete the partially written bytes from the data file by
-				// seeking to the previously known position and performing
-				// a truncate operation.
+				// truncating it to the previously known size.
 				// At this point a syscall failure is fatal and the process
 				// should be killed to avoid corrupting the file.
-				pos, err := tx.db.file.Seek(-int64(n), 1)
+				size, err := tx.db.file.Size()
+				pos := size - int64(n)
 				if err != nil {
 					log.Panic().Caller().Err(err).
 						Msg("Partial write, truncation recovery failed, catastrophic failure.")
@@ -1117,16 +2178,46 @@ func (tx *Tx) Commit() error {
 			}
 			tx.rollbackInner()
 		}
-		if tx.db.config.SyncPolicy == Always {
-			_ = tx.db.file.Sync()
+		if err == nil && (tx.db.config.SyncPolicy == Always ||
+			tx.db.syncDue(n)) {
+			// The file is synced after the database is unlocked, together
+			// with the writes of other commits.
+			file, ticket = tx.db.file, tx.db.gsync.add()
 		}
 		// Increment the number of flushes. The background syncing uses this.
 		tx.db.flushes++
 	}
+	if err == nil && len(tx.wc.commitItems) > 0 {
+		tx.db.seq = tx.wc.seq
+		// New transactions see the changes from now on.
+		tx.db.publish(tx.wc.commitItems)
+		tx.db.notify(tx.wc.seq, tx.wc.commitItems, ticket)
+		if tx.db.backlog != nil {
+			// Followers are sent the same records as the file.
+			tx.db.backlog.add(tx.wc.seq, tx.db.buf)
+		}
+		if onCommit != nil {
+			changes = tx.db.events(tx.wc.seq, tx.wc.commitItems)
+		}
+	} else if err == nil && len(tx.wc.rollbackIndexes) > 0 {
+		// An index that is not written to the file was created.
+		tx.db.publish(nil)
+	}
 	// Unlock the database and allow for another writable transaction.
 	tx.unlock()
+	if file != nil {
+		// Wait until the changes are on disk.
+		tx.db.gsync.wait(ticket, file)
+	}
+	if err == nil && len(tx.wc.commitItems) > 0 {
+		// The events are sent once the changes are on disk.
+		tx.db.deliver()
+	}
 	// Clear the db field to disable this transaction from future use.
 	tx.db = nil
+	if changes != nil {
+		onCommit(changes)
+	}
 	return err
 }
 
@@ -1141,8 +2232,9 @@ func (tx *Tx) Rollback() error {
 	if tx.db == nil {
 		return ErrTxClosed
 	}
-	// The rollback func does the heavy lifting.
-	if tx.writable {
+	// The rollback func does the heavy lifting. The changes of an optimistic
+	// transaction were never made to the database.
+	if tx.writable && !tx.optimistic() {
 		tx.rollbackInner()
 	}
 	// unlock the database for more transactions.
@@ -1158,9 +2250,21 @@ type dbItemOpts struct {
 	exat time.Time // when does this item expire?
 }
 type dbItem struct {
-	key, val string      // the binary key and value
-	opts     *dbItemOpts // optional meta information
-	keyless  bool        // keyless item for scanning
+	key, val   string      // the binary key and value
+	opts       *dbItemOpts // optional meta information
+	keyless    bool        // keyless item for scanning
+	compressed bool        // the val is compressed by the codec of the db
+	rev        uint64      // the sequence of the commit that set the item
+}
+
+// optsCopy returns a copy of the item options, or nil if the item is nil or
+// has no options.
+func (dbi *dbItem) optsCopy() *dbItemOpts {
+	if dbi == nil || dbi.opts == nil {
+		return nil
+	}
+	opts := *dbi.opts
+	return &opts
 }
 
 // estIntSize returns the string representions size.
@@ -1189,14 +2293,15 @@ func estBulkStringSize(s string) int {
 // estAOFSetSize returns an estimated number of bytes that this item will use
 // when stored in the aof file.
 func (dbi *dbItem) estAOFSetSize() int {
-	var n int
+	n := estBulkStringSize("rev")
+	n += 6 + estIntSize(int(dbi.rev)) // the revision bulk string
 	if dbi.opts != nil && dbi.opts.ex {
 		n += estArraySize(5)
 		n += estBulkStringSize("set")
 		n += estBulkStringSize(dbi.key)
 		n += estBulkStringSize(dbi.val)
-		n += estBulkStringSize("ex")
-		n += estBulkStringSize("99") // estimate two byte bulk string
+		n += estBulkStringSize("pxat")
+		n += estBulkStringSize("9999999999999") // unix milliseconds
 	} else {
 		n += estArraySize(3)
 		n += estBulkStringSize("set")
@@ -1223,21 +2328,62 @@ func appendBulkString(buf []byte, s string) []byte {
 }
 
 // writeSetTo writes an item as a single SET record to the a bufio Writer.
-func (dbi *dbItem) writeSetTo(buf []byte, now time.Time) []byte {
-	if dbi.opts != nil && dbi.opts.ex {
-		ex := dbi.opts.exat.Sub(now) / time.Second
-		buf = appendArray(buf, 5)
-		buf = appendBulkString(buf, "set")
-		buf = appendBulkString(buf, dbi.key)
-		buf = appendBulkString(buf, dbi.val)
-		buf = appendBulkString(buf, "ex")
-		buf = appendBulkString(buf, strconv.FormatUint(uint64(ex), 10))
-	} else {
-		buf = appendArray(buf, 3)
-		buf = appendBulkString(buf, "set")
-		buf = appendBulkString(buf, dbi.key)
-		buf = appendBulkString(buf, dbi.val)
+// An expiration is written as an absolute unix time in milliseconds. The
+// revision is written when rev is true, otherwise the item takes the revision
+// from the sequence of the transaction that contains the record. A value that
+// is compressed is followed by the name of its codec.
+func (dbi *dbItem) writeSetTo(buf []byte, rev bool, zip *compression) []byte {
+	n := 3
+	val, codec := dbi.val, ""
+	if zip != nil {
+		val, codec = zip.encode(dbi)
+	}
+	if codec != "" {
+		n += 2
+	}
+	ex := dbi.opts != nil && dbi.opts.ex
+	if ex {
+		n += 2
+	}
+	if rev {
+		n += 2
+	}
+	buf = appendArray(buf, n)
+	buf = appendBulkString(buf, "set")
+	buf = appendBulkString(buf, dbi.key)
+	buf = appendBulkString(buf, val)
+	if codec != "" {
+		buf = appendBulkString(buf, "codec")
+		buf = appendBulkString(buf, codec)
 	}
+	if ex {
+		pxat := dbi.opts.exat.UnixNano() / int64(time.Millisecond)
+		buf = appendBulkString(buf, "pxat")
+		buf = appendBulkString(buf, strconv.FormatInt(pxat, 10))
+	}
+	if rev {
+		buf = appendBulkString(buf, "rev")
+		buf = appendBulkString(buf, strconv.FormatUint(dbi.rev, 10))
+	}
+	return buf
+}
+
+// writeHeaderTo writes the records at the top of a snapshot, which are the
+// index definitions and the current sequence.
+func (db *DB) writeHeaderTo(buf []byte) []byte {
+	buf = db.writeIndexesTo(buf)
+	if db.seq != 0 {
+		buf = appendSeq(buf, db.seq)
+	}
+	return buf
+}
+
+// appendSeq writes a single SEQ record, which sets the sequence of the
+// transaction that contains it.
+func appendSeq(buf []byte, seq uint64) []byte {
+	buf = appendArray(buf, 2)
+	buf = appendBulkString(buf, "seq")
+	buf = appendBulkString(buf, strconv.FormatUint(seq, 10))
 	return buf
 }
 
@@ -1287,10 +2433,11 @@ func (dbi *dbItem) Less(dbi2 *dbItem, ctx interface{}) bool {
 	case *index:
 		if ctx.less != nil {
 			// Using an index
-			if ctx.less(dbi.val, dbi2.val) {
+			val, val2 := ctx.db.value(dbi), ctx.db.value(dbi2)
+			if ctx.less(val, val2) {
 				return true
 			}
-			if ctx.less(dbi2.val, dbi.val) {
+			if ctx.less(val2, val) {
 				return false
 			}
 		}
@@ -1315,7 +2462,7 @@ func lessCtx(ctx interface{}) func(a, b interface{}) bool {
 func (dbi *dbItem) Rect(ctx interface{}) (min, max []float64) {
 	switch ctx := ctx.(type) {
 	case *index:
-		return ctx.rect(dbi.val)
+		return ctx.rect(ctx.db.value(dbi))
 	}
 	return nil, nil
 }
@@ -1338,7 +2485,7 @@ func (tx *Tx) GetLess(index string) (func(a, b string) bool, error) {
 	if tx.db == nil {
 		return nil, ErrTxClosed
 	}
-	idx, ok := tx.db.idxs[index]
+	idx, ok := tx.trees().idxs[index]
 	if !ok || idx.less == nil {
 		return nil, ErrNotFound
 	}
@@ -1354,7 +2501,7 @@ func (tx *Tx) GetRect(index string) (func(s string) (min, max []float64),
 	if tx.db == nil {
 		return nil, ErrTxClosed
 	}
-	idx, ok := tx.db.idxs[index]
+	idx, ok := tx.trees().idxs[index]
 	if !ok || idx.rect == nil {
 		return nil, ErrNotFound
 	}
@@ -1374,14 +2521,11 @@ func (tx *Tx) GetRect(index string) (func(s string) (min, max []float64),
 // This operation is not allowed during iterations such as Ascend* & Descend*.
 func (tx *Tx) Set(key, value string, opts *SetOptions) (previousValue string,
 	replaced bool, err error) {
-	if tx.db == nil {
-		return "", false, ErrTxClosed
-	} else if !tx.writable {
-		return "", false, ErrTxNotWritable
-	} else if tx.wc.itercount > 0 {
-		return "", false, ErrTxIterating
+	if err := tx.writeCheck(); err != nil {
+		return "", false, err
 	}
 	item := &dbItem{key: key, val: value}
+	tx.db.zip.pack(item)
 	if opts != nil {
 		if opts.Expires {
 			// The caller is requesting that this item expires. Convert the
@@ -1389,8 +2533,37 @@ func (tx *Tx) Set(key, value string, opts *SetOptions) (previousValue string,
 			item.opts = &dbItemOpts{ex: true, exat: time.Now().Add(opts.TTL)}
 		}
 	}
+	previousValue, replaced = tx.set(item)
+	return previousValue, replaced, nil
+}
+
+// insert inserts or replaces an item in the database, or in the private trees
+// of an optimistic transaction, and returns the previous item.
+func (tx *Tx) insert(item *dbItem) *dbItem {
+	if tx.optimistic() {
+		tx.wc.reads.addKey(item.key)
+		return tx.private().set(item, false)
+	}
+	return tx.db.insertIntoDatabase(item)
+}
+
+// remove removes an item from the database, or from the private trees of an
+// optimistic transaction, and returns the removed item.
+func (tx *Tx) remove(key string) *dbItem {
+	if tx.optimistic() {
+		tx.wc.reads.addKey(key)
+		return tx.private().delete(&dbItem{key: key})
+	}
+	return tx.db.deleteFromDatabase(&dbItem{key: key})
+}
+
+// set inserts or replaces an item in the database and records the change for
+// rollbacks and commits.
+func (tx *Tx) set(item *dbItem) (previousValue string, replaced bool) {
+	key := item.key
+	item.rev = tx.wc.seq
 	// Insert the item into the keys tree.
-	prev := tx.db.insertIntoDatabase(item)
+	prev := tx.insert(item)
 
 	// insert into the rollback map if there has not been a deleteAll.
 	if tx.wc.rbkeys == nil {
@@ -1411,16 +2584,15 @@ func (tx *Tx) Set(key, value string, opts *SetOptions) (previousValue string,
 				tx.wc.rollbackItems[key] = prev
 			}
 			if !prev.expired() {
-				previousValue, replaced = prev.val, true
+				previousValue, replaced = tx.db.value(prev), true
 			}
 		}
 	}
-	// For commits we simply assign the item to the map. We use this map to
-	// write the entry to disk.
-	if tx.db.persist {
-		tx.wc.commitItems[key] = item
-	}
-	return previousValue, replaced, nil
+	// For commits we simply append the item to the list. We use this list
+	// to write the entry to disk.
+	tx.addCommit(&commitItem{cmd: cmdSet, key: key, item: item, prev: prev,
+		expired: prev != nil && prev.expired()})
+	return previousValue, replaced
 }
 
 // Get returns a value for a key. If the item does not exist or if the item
@@ -1434,13 +2606,227 @@ func (tx *Tx) Get(key string, ignoreExpired ...bool) (val string, err error) {
 	if len(ignoreExpired) != 0 {
 		ignore = ignoreExpired[0]
 	}
-	item := tx.db.get(key)
+	item := tx.get(key)
 	if item == nil || (item.expired() && !ignore) {
 		// The item does not exists or has expired. Let's assume that
 		// the caller is only interested in items that have not expired.
 		return "", ErrNotFound
 	}
-	return item.val, nil
+	return tx.db.value(item), nil
+}
+
+// writeCheck returns an error if the transaction cannot write.
+func (tx *Tx) writeCheck() error {
+	if tx.db == nil {
+		return ErrTxClosed
+	} else if !tx.writable {
+		return ErrTxNotWritable
+	} else if tx.wc.itercount > 0 {
+		return ErrTxIterating
+	}
+	return nil
+}
+
+// current returns the value for a key, and false if the item does not exist
+// or has expired.
+func (tx *Tx) current(key string) (val string, ok bool) {
+	item := tx.get(key)
+	if item == nil || item.expired() {
+		return "", false
+	}
+	return tx.db.value(item), true
+}
+
+// SetNX inserts an item only if an item with the same key does not exist.
+// ErrConditionFailed is returned when the item already exists.
+//
+// Only a writable transaction can be used for this operation.
+// This operation is not allowed during iterations such as Ascend* & Descend*.
+func (tx *Tx) SetNX(key, value string, opts *SetOptions) error {
+	if err := tx.writeCheck(); err != nil {
+		return err
+	}
+	if _, ok := tx.current(key); ok {
+		return ErrConditionFailed
+	}
+	_, _, err := tx.Set(key, value, opts)
+	return err
+}
+
+// SetXX replaces an item only if an item with the same key already exists,
+// and returns the previous value.
+// ErrConditionFailed is returned when the item does not exist.
+//
+// Only a writable transaction can be used for this operation.
+// This operation is not allowed during iterations such as Ascend* & Descend*.
+func (tx *Tx) SetXX(key, value string, opts *SetOptions) (
+	previousValue string, err error) {
+	if err := tx.writeCheck(); err != nil {
+		return "", err
+	}
+	if _, ok := tx.current(key); !ok {
+		return "", ErrConditionFailed
+	}
+	previousValue, _, err = tx.Set(key, value, opts)
+	return previousValue, err
+}
+
+// CompareAndSwap replaces the value of an item only if its current value is
+// equal to oldValue.
+// ErrConditionFailed is returned when the item does not exist or the value
+// does not match.
+//
+// Only a writable transaction can be used for this operation.
+// This operation is not allowed during iterations such as Ascend* & Descend*.
+func (tx *Tx) CompareAndSwap(key, oldValue, newValue string,
+	opts *SetOptions) error {
+	if err := tx.writeCheck(); err != nil {
+		return err
+	}
+	if val, ok := tx.current(key); !ok || val != oldValue {
+		return ErrConditionFailed
+	}
+	_, _, err := tx.Set(key, newValue, opts)
+	return err
+}
+
+// CompareAndDelete removes an item only if its current value is equal to
+// oldValue.
+// ErrConditionFailed is returned when the item does not exist or the value
+// does not match.
+//
+// Only a writable transaction can be used for this operation.
+// This operation is not allowed during iterations such as Ascend* & Descend*.
+func (tx *Tx) CompareAndDelete(key, oldValue string) error {
+	if err := tx.writeCheck(); err != nil {
+		return err
+	}
+	if val, ok := tx.current(key); !ok || val != oldValue {
+		return ErrConditionFailed
+	}
+	_, err := tx.Delete(key)
+	return err
+}
+
+// GetWithVersion returns a value for a key along with the version of the
+// item. The version is the sequence of the transaction that last set the item,
+// which increases with every committed transaction. If the item does not exist
+// or if the item has expired then ErrNotFound is returned. If ignoreExpired is
+// true, then the found value will be returned even if it is expired.
+func (tx *Tx) GetWithVersion(key string, ignoreExpired ...bool) (val string,
+	version uint64, err error) {
+	if tx.db == nil {
+		return "", 0, ErrTxClosed
+	}
+	var ignore bool
+	if len(ignoreExpired) != 0 {
+		ignore = ignoreExpired[0]
+	}
+	item := tx.get(key)
+	if item == nil || (item.expired() && !ignore) {
+		return "", 0, ErrNotFound
+	}
+	return tx.db.value(item), item.rev, nil
+}
+
+// SetIfVersion inserts or replaces an item only if the version of the
+// current item is equal to the provided version. A version of zero means
+// that the item must not exist.
+// ErrConditionFailed is returned when the version does not match.
+//
+// Only a writable transaction can be used for this operation.
+// This operation is not allowed during iterations such as Ascend* & Descend*.
+func (tx *Tx) SetIfVersion(key, value string, version uint64,
+	opts *SetOptions) error {
+	if err := tx.writeCheck(); err != nil {
+		return err
+	}
+	var rev uint64
+	if item := tx.get(key); item != nil && !item.expired() {
+		rev = item.rev
+	}
+	if rev != version {
+		return ErrConditionFailed
+	}
+	_, _, err := tx.Set(key, value, opts)
+	return err
+}
+
+// Incr increments the number stored at key by one, and returns the new value.
+// See IncrBy for details.
+func (tx *Tx) Incr(key string) (int64, error) {
+	return tx.IncrBy(key, 1)
+}
+
+// Decr decrements the number stored at key by one, and returns the new value.
+// See IncrBy for details.
+func (tx *Tx) Decr(key string) (int64, error) {
+	return tx.IncrBy(key, -1)
+}
+
+// IncrBy increments the integer stored at key by delta, and returns the new
+// value. An item that does not exist is set to delta. The expiration of an
+// existing item is kept.
+// ErrNotNumeric is returned when the current value is not an integer, and
+// ErrInvalidOperation is returned when the result would overflow.
+//
+// Only a writable transaction can be used for this operation.
+// This operation is not allowed during iterations such as Ascend* & Descend*.
+func (tx *Tx) IncrBy(key string, delta int64) (int64, error) {
+	if err := tx.writeCheck(); err != nil {
+		return 0, err
+	}
+	var n int64
+	prev := tx.get(key)
+	if prev != nil && !prev.expired() {
+		var err error
+		n, err = strconv.ParseInt(tx.db.value(prev), 10, 64)
+		if err != nil {
+			return 0, ErrNotNumeric
+		}
+	} else {
+		prev = nil
+	}
+	if (delta > 0 && n > math.MaxInt64-delta) ||
+		(delta < 0 && n < math.MinInt64-delta) {
+		return 0, ErrInvalidOperation
+	}
+	n += delta
+	tx.set(&dbItem{key: key, val: strconv.FormatInt(n, 10),
+		opts: prev.optsCopy()})
+	return n, nil
+}
+
+// IncrByFloat increments the number stored at key by delta, and returns the
+// new value. An item that does not exist is set to delta. The expiration of an
+// existing item is kept.
+// ErrNotNumeric is returned when the current value is not a number, and
+// ErrInvalidOperation is returned when the result is not finite.
+//
+// Only a writable transaction can be used for this operation.
+// This operation is not allowed during iterations such as Ascend* & Descend*.
+func (tx *Tx) IncrByFloat(key string, delta float64) (float64, error) {
+	if err := tx.writeCheck(); err != nil {
+		return 0, err
+	}
+	var n float64
+	prev := tx.get(key)
+	if prev != nil && !prev.expired() {
+		var err error
+		n, err = strconv.ParseFloat(tx.db.value(prev), 64)
+		if err != nil || math.IsNaN(n) || math.IsInf(n, 0) {
+			return 0, ErrNotNumeric
+		}
+	} else {
+		prev = nil
+	}
+	n += delta
+	if math.IsNaN(n) || math.IsInf(n, 0) {
+		return 0, ErrInvalidOperation
+	}
+	tx.set(&dbItem{key: key, val: strconv.FormatFloat(n, 'f', -1, 64),
+		opts: prev.optsCopy()})
+	return n, nil
 }
 
 // Delete removes an item from the database based on the item's key. If the item
@@ -1449,14 +2835,10 @@ func (tx *Tx) Get(key string, ignoreExpired ...bool) (val string, err error) {
 // Only a writable transaction can be used for this operation.
 // This operation is not allowed during iterations such as Ascend* & Descend*.
 func (tx *Tx) Delete(key string) (val string, err error) {
-	if tx.db == nil {
-		return "", ErrTxClosed
-	} else if !tx.writable {
-		return "", ErrTxNotWritable
-	} else if tx.wc.itercount > 0 {
-		return "", ErrTxIterating
+	if err := tx.writeCheck(); err != nil {
+		return "", err
 	}
-	item := tx.db.deleteFromDatabase(&dbItem{key: key})
+	item := tx.remove(key)
 	if item == nil {
 		return "", ErrNotFound
 	}
@@ -1466,17 +2848,17 @@ func (tx *Tx) Delete(key string) (val string, err error) {
 			tx.wc.rollbackItems[key] = item
 		}
 	}
-	if tx.db.persist {
-		tx.wc.commitItems[key] = nil
-	}
+	expired := item.expired()
+	tx.addCommit(&commitItem{cmd: cmdDel, key: key, prev: item,
+		expired: expired})
 	// Even though the item has been deleted, we still want to check
 	// if it has expired. An expired item should not be returned.
-	if item.expired() {
+	if expired {
 		// The item exists in the tree, but has expired. Let's assume that
 		// the caller is only interested in items that have not expired.
 		return "", ErrNotFound
 	}
-	return item.val, nil
+	return tx.db.value(item), nil
 }
 
 // TTL returns the remaining time-to-live for an item.
@@ -1486,7 +2868,7 @@ func (tx *Tx) TTL(key string) (time.Duration, error) {
 	if tx.db == nil {
 		return 0, ErrTxClosed
 	}
-	item := tx.db.get(key)
+	item := tx.get(key)
 	if item == nil {
 		return 0, ErrNotFound
 	} else if item.opts == nil || !item.opts.ex {
@@ -1515,20 +2897,31 @@ func (tx *Tx) scan(desc, gt, lt bool, index, start, stop string,
 		return ErrTxClosed
 	}
 	// wrap a btree specific iterator around the user-defined iterator.
+	// The scan stops when the context of the transaction is done.
+	done := tx.done()
+	var err error
 	iter := func(item interface{}) bool {
+		select {
+		case <-done:
+			err = tx.ctx.Err()
+			return false
+		default:
+		}
 		dbi := item.(*dbItem)
-		return iterator(dbi.key, dbi.val)
+		return iterator(dbi.key, tx.db.value(dbi))
 	}
 	var tr *btree.BTree
 	if index == "" {
 		// empty index means we will use the keys tree.
-		tr = tx.db.keys
+		tr = tx.trees().keys
+		tx.reads().addRange(desc, gt, lt, start, stop)
 	} else {
-		idx := tx.db.idxs[index]
+		idx := tx.trees().idxs[index]
 		if idx == nil {
 			// index was not found. return error
 			return ErrNotFound
 		}
+		tx.reads().addIndex(idx)
 		tr = idx.btr
 		if tr == nil {
 			return nil
@@ -1581,7 +2974,7 @@ func (tx *Tx) scan(desc, gt, lt bool, index, start, stop string,
 			btreeAscend(tr, iter)
 		}
 	}
-	return nil
+	return err
 }
 
 // Match returns true if the specified key matches the pattern. This is a very
@@ -1596,7 +2989,8 @@ func (tx *Tx) Len() (int, error) {
 	if tx.db == nil {
 		return 0, ErrTxClosed
 	}
-	return tx.db.keys.Len(), nil
+	tx.reads().addAll()
+	return tx.trees().keys.Len(), nil
 }
 
 // Point is a helper function that converts a series of float64s
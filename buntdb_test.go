@@ -1,12 +1,19 @@
 package buntdb
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
 	"math/rand"
+	"net"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -776,7 +783,6 @@ func TestVariousTx(t *testing.T) {
 	}); err != ErrTxClosed {
 		t.Fatal("expecting tx closed error")
 	}
-	db.RUnlock()
 	// flush to unwritable file
 	if err := db.Update(func(tx *Tx) error {
 		_, _, err := tx.Set("var1", "val1", nil)
@@ -787,13 +793,10 @@ func TestVariousTx(t *testing.T) {
 	}); err == nil {
 		t.Fatal("should not be able to commit when the file is closed")
 	}
-	db.file, err = os.OpenFile("data.db", os.O_CREATE|os.O_RDWR, 0666)
+	db.file, err = openFileStorage("data.db", false)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if _, err := db.file.Seek(0, 2); err != nil {
-		t.Fatal(err)
-	}
 	db.buf = nil
 	if err := db.CreateIndex("blank", "*", nil); err != nil {
 		t.Fatal(err)
@@ -1396,6 +1399,43 @@ func TestDatabaseFormat(t *testing.T) {
 	testFormat(t, true, "*3\r\n$3\r\nSET\r\n$5\r\nHELLO\r\n$5\r\nWORLD\r\n", nil)
 	testFormat(t, true, "*1\r\n$7\r\nFLUSHDB\r\n", nil)
 
+	// absolute expirations
+	pxat := func(key string, ms int64) string {
+		sms := strconv.FormatInt(ms, 10)
+		return "*5\r\n$3\r\nset\r\n$" + strconv.Itoa(len(key)) + "\r\n" +
+			key + "\r\n$3\r\nval\r\n$4\r\npxat\r\n$" +
+			strconv.Itoa(len(sms)) + "\r\n" + sms + "\r\n"
+	}
+	future := time.Now().Add(time.Hour).UnixNano() / int64(time.Millisecond)
+	testFormat(t, true, pxat("key1", future)+pxat("key2", 1000),
+		func(db *DB) error {
+			return db.View(func(tx *Tx) error {
+				ttl, err := tx.TTL("key1")
+				if err != nil {
+					return err
+				}
+				if ttl <= 59*time.Minute || ttl > time.Hour {
+					return fmt.Errorf("unexpected ttl %v", ttl)
+				}
+				if _, err := tx.Get("key2"); err != ErrNotFound {
+					return fmt.Errorf("expected %v, got %v", ErrNotFound, err)
+				}
+				return nil
+			})
+		})
+	// an expired item removes the previous item
+	testFormat(t, true, "*3\r\n$3\r\nset\r\n$4\r\nkey1\r\n$3\r\nval\r\n"+
+		pxat("key1", 1000), func(db *DB) error {
+		return db.View(func(tx *Tx) error {
+			if _, err := tx.Get("key1"); err != ErrNotFound {
+				return fmt.Errorf("expected %v, got %v", ErrNotFound, err)
+			}
+			return nil
+		})
+	})
+	testFormat(t, false, "*5\r\n$3\r\nset\r\n$3\r\nkey\r\n$3\r\nval\r\n"+
+		"$4\r\npxat\r\n$3\r\nabc\r\n", nil)
+
 	// commands with invalid names or arguments
 	testFormat(t, false, "*3\r\n$3\r\nDEL\r\n$5\r\nHELLO\r\n$5\r\nWORLD\r\n", nil)
 	testFormat(t, false, "*2\r\n$3\r\nSET\r\n$5\r\nHELLO\r\n", nil)
@@ -1420,6 +1460,42 @@ func TestDatabaseFormat(t *testing.T) {
 			})
 	}
 
+	// partial transactions should be ignored but allowed
+	ptx := "*1\r\n$5\r\nbegin\r\n" + pcmd + pcmd + "*1\r\n$6\r\ncommit\r\n"
+	for i := 1; i < len(ptx); i++ {
+		cmd := "*3\r\n$3\r\nSET\r\n$5\r\nHELLO\r\n$5\r\nJELLO\r\n"
+		testFormat(t, true, cmd+ptx[:len(ptx)-i],
+			func(db *DB) error {
+				return db.View(func(tx *Tx) error {
+					val, err := tx.Get("HELLO")
+					if err != nil {
+						return err
+					}
+					if val != "JELLO" {
+						return fmt.Errorf("expected '%s', got '%s'", "JELLO", val)
+					}
+					return nil
+				})
+			})
+	}
+	testFormat(t, true, ptx, func(db *DB) error {
+		return db.View(func(tx *Tx) error {
+			val, err := tx.Get("HELLO")
+			if err != nil {
+				return err
+			}
+			if val != "WORLD" {
+				return fmt.Errorf("expected '%s', got '%s'", "WORLD", val)
+			}
+			return nil
+		})
+	})
+
+	// transactions with invalid framing
+	testFormat(t, false, "*1\r\n$5\r\nbegin\r\n*1\r\n$5\r\nbegin\r\n", nil)
+	testFormat(t, false, "*1\r\n$6\r\ncommit\r\n", nil)
+	testFormat(t, false, "*1\r\n$5\r\nbegin\r\n*2\r\n$6\r\ncommit\r\n$2\r\nzz\r\n", nil)
+
 	// commands with invalid formatting
 	testFormat(t, false, "^3\r\n$3\r\nSET\r\n$5\r\nHELLO\r\n$5\r\nWORLD\r\n", nil)
 	testFormat(t, false, "*3\n$3\r\nSET\r\n$5\r\nHELLO\r\n$5\r\nWORLD\r\n", nil)
@@ -2498,6 +2574,76 @@ func Benchmark_Descend_10000(t *testing.B) {
 	benchScan(t, false, 10000)
 }
 
+// Benchmark_Set_Spatial sets a key in a database with a spatial index of
+// many items, one key per commit.
+func Benchmark_Set_Spatial(t *testing.B) {
+	db := testOpen(t)
+	defer testClose(db)
+	if err := db.Update(func(tx *Tx) error {
+		if err := tx.CreateSpatialIndex("pts", "pt:*", IndexRect); err != nil {
+			return err
+		}
+		for i := 0; i < 100000; i++ {
+			pt := fmt.Sprintf("[%d %d]", i%1000, i/1000)
+			_, _, err := tx.Set(fmt.Sprintf("pt:%d", i), pt, nil)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	t.ResetTimer()
+	for i := 0; i < t.N; i++ {
+		if err := db.Update(func(tx *Tx) error {
+			pt := fmt.Sprintf("[%d %d]", i%1000, i%997)
+			_, _, err := tx.Set(fmt.Sprintf("pt:%d", i%100000), pt, nil)
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func Benchmark_Set_Spatial_Reader(t *testing.B) {
+	db := testOpen(t)
+	defer testClose(db)
+	if err := db.Update(func(tx *Tx) error {
+		if err := tx.CreateSpatialIndex("pts", "pt:*", IndexRect); err != nil {
+			return err
+		}
+		for i := 0; i < 100000; i++ {
+			pt := fmt.Sprintf("[%d %d]", i%1000, i/1000)
+			_, _, err := tx.Set(fmt.Sprintf("pt:%d", i), pt, nil)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	t.ResetTimer()
+	for i := 0; i < t.N; i++ {
+		// a reader has the latest version open during every commit.
+		rtx, err := db.Begin(false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Update(func(tx *Tx) error {
+			pt := fmt.Sprintf("[%d %d]", i%1000, i%997)
+			_, _, err := tx.Set(fmt.Sprintf("pt:%d", i%100000), pt, nil)
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if err := rtx.Rollback(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
 /*
 func Benchmark_Spatial_2D(t *testing.B) {
 	N := 100000
@@ -2695,7 +2841,10 @@ func TestOnExpiredSync(t *testing.T) {
 	}
 
 	done := make(chan struct{})
+	exited := make(chan struct{})
+	defer func() { <-exited }()
 	go func() {
+		defer close(exited)
 		ticks := time.NewTicker(time.Millisecond * 50)
 		defer ticks.Stop()
 		for {
@@ -2735,7 +2884,9 @@ OUTER1:
 			}
 		}
 	}
-	err = db.View(func(tx *Tx) error {
+	// the hit is sent before the change is committed, which a read/write
+	// transaction waits for.
+	err = db.Update(func(tx *Tx) error {
 		defer close(done)
 		v, err := tx.Get("K")
 		if err != nil {
@@ -2918,3 +3069,2270 @@ func TestWrappedError(t *testing.T) {
 	}()
 	panicErr(errors.New("my fake error"))
 }
+
+func TestIndexPersistence(t *testing.T) {
+	lessLen := func(a, b string) bool { return len(a) < len(b) }
+	opts := Options{
+		Comparators: map[string]func(a, b string) bool{"len": lessLen},
+	}
+	os.RemoveAll("data.db")
+	defer os.RemoveAll("data.db")
+	db, err := OpenWithOptions("data.db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *Tx) error {
+		for i, name := range []string{"tom", "jo", "alexander", "sam"} {
+			key := fmt.Sprintf("user:%d", i)
+			val := fmt.Sprintf(`{"name":"%s","age":%d}`, name, 40-i)
+			if _, _, err := tx.Set(key, val, nil); err != nil {
+				return err
+			}
+		}
+		_, _, err := tx.Set("pos:1", "[1 2]", nil)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	size, err := db.file.Size()
+	assert.Assert(err == nil)
+	// an index of functions without names is not written to the file.
+	assert.Assert(db.CreateIndex("mem", "*", func(a, b string) bool {
+		return a < b
+	}) == nil)
+	assert.Assert(db.CreateIndex("str", "*", IndexString) == nil)
+	assert.Assert(db.CreateIndex("tmp", "*", IndexString) == nil)
+	assert.Assert(db.DropIndex("tmp") == nil)
+	n, err := db.file.Size()
+	assert.Assert(err == nil && n == size)
+	assert.Assert(db.Update(func(tx *Tx) error {
+		if err := tx.CreateIndexNamed("name", "user:*", nil,
+			"json:name"); err != nil {
+			return err
+		}
+		if err := tx.CreateIndexNamed("age", "user:*", nil,
+			"desc:json:age"); err != nil {
+			return err
+		}
+		if err := tx.CreateIndexNamed("len", "*", nil, "desc:len"); err != nil {
+			return err
+		}
+		if err := tx.CreateIndexNamed("gone", "*", nil, "string"); err != nil {
+			return err
+		}
+		if err := tx.DropIndex("gone"); err != nil {
+			return err
+		}
+		if err := tx.CreateSpatialIndexNamed("pos", "pos:*", nil,
+			"rect"); err != nil {
+			return err
+		}
+		return tx.CreateIndexNamed("ci", "USER:*",
+			&IndexOptions{CaseInsensitiveKeyMatching: true}, "int")
+	}) == nil)
+	// a function must have a name that is known to the database.
+	assert.Assert(db.Update(func(tx *Tx) error {
+		err := tx.CreateIndexNamed("bad", "*", nil, "string", "nope")
+		assert.Assert(errors.Is(err, ErrUnknownFunc))
+		err = tx.CreateSpatialIndexNamed("bad", "*", nil, "nope")
+		assert.Assert(errors.Is(err, ErrUnknownFunc))
+		// and there must be at least one.
+		err = tx.CreateIndexNamed("bad", "*", nil)
+		assert.Assert(err == ErrInvalid)
+		return nil
+	}) == nil)
+	tx, err := db.Begin(false)
+	assert.Assert(err == nil)
+	assert.Assert(tx.CreateIndexNamed("bad", "*", nil, "string") == ErrTxNotWritable)
+	assert.Assert(tx.CreateSpatialIndexNamed("bad", "*", nil, "rect") == ErrTxNotWritable)
+	assert.Assert(tx.Rollback() == nil)
+	assert.Assert(tx.CreateIndexNamed("bad", "*", nil, "string") == ErrTxClosed)
+	assert.Assert(tx.CreateSpatialIndexNamed("bad", "*", nil, "rect") == ErrTxClosed)
+
+	check := func(db *DB, indexes string) {
+		t.Helper()
+		names, err := db.Indexes()
+		assert.Assert(err == nil)
+		assert.Assert(strings.Join(names, ",") == indexes)
+		err = db.View(func(tx *Tx) error {
+			var keys []string
+			err := tx.Ascend("name", func(key, val string) bool {
+				keys = append(keys, key)
+				return true
+			})
+			assert.Assert(err == nil)
+			assert.Assert(strings.Join(keys, ",") == "user:2,user:1,user:3,user:0")
+			keys = keys[:0]
+			err = tx.Ascend("age", func(key, val string) bool {
+				keys = append(keys, key)
+				return true
+			})
+			assert.Assert(err == nil)
+			assert.Assert(strings.Join(keys, ",") == "user:0,user:1,user:2,user:3")
+			var n int
+			err = tx.Intersects("pos", "[0 0],[5 5]", func(key, val string) bool {
+				n++
+				return true
+			})
+			assert.Assert(err == nil && n == 1)
+			return nil
+		})
+		assert.Assert(err == nil)
+	}
+	check(db, "age,ci,len,mem,name,pos,str")
+	assert.Assert(db.Close() == nil)
+
+	// the custom comparator must be registered to load the file.
+	_, err = Open("data.db")
+	assert.Assert(errors.Is(err, ErrInvalid))
+
+	db, err = OpenWithOptions("data.db", opts)
+	assert.Assert(err == nil)
+	check(db, "age,ci,len,name,pos")
+	assert.Assert(db.Update(func(tx *Tx) error { return tx.DeleteAll() }) == nil)
+	assert.Assert(db.Update(func(tx *Tx) error {
+		for i, name := range []string{"tom", "jo", "alexander", "sam"} {
+			key := fmt.Sprintf("user:%d", i)
+			val := fmt.Sprintf(`{"name":"%s","age":%d}`, name, 40-i)
+			if _, _, err := tx.Set(key, val, nil); err != nil {
+				return err
+			}
+		}
+		_, _, err := tx.Set("pos:1", "[1 2]", nil)
+		return err
+	}) == nil)
+	assert.Assert(db.Shrink() == nil)
+	assert.Assert(db.Close() == nil)
+
+	db, err = OpenWithOptions("data.db", opts)
+	assert.Assert(err == nil)
+	defer db.Close()
+	check(db, "age,ci,len,name,pos")
+}
+
+func TestBinarySnapshot(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	var config Config
+	assert.Assert(db.ReadConfig(&config) == nil)
+	config.SnapshotFormat = SnapshotFormat(2)
+	assert.Assert(db.SetConfig(config) == ErrInvalidSnapshotFormat)
+	config.SnapshotFormat = BinarySnapshot
+	assert.Assert(db.SetConfig(config) == nil)
+	assert.Assert(db.Update(func(tx *Tx) error {
+		return tx.CreateIndexNamed("vals", "*", nil, "int")
+	}) == nil)
+	assert.Assert(db.Update(func(tx *Tx) error {
+		for i := 0; i < 1000; i++ {
+			var opts *SetOptions
+			if i%2 == 0 {
+				opts = &SetOptions{Expires: true, TTL: time.Hour}
+			}
+			key := fmt.Sprintf("key:%04d", i)
+			if _, _, err := tx.Set(key, strconv.Itoa(1000-i), opts); err != nil {
+				return err
+			}
+		}
+		return nil
+	}) == nil)
+	assert.Assert(db.Shrink() == nil)
+	assert.Assert(db.Update(func(tx *Tx) error {
+		_, err := tx.Delete("key:0000")
+		return err
+	}) == nil)
+
+	check := func(db *DB) {
+		t.Helper()
+		assert.Assert(db.View(func(tx *Tx) error {
+			n, err := tx.Len()
+			assert.Assert(err == nil && n == 999)
+			ttl, err := tx.TTL("key:0002")
+			assert.Assert(err == nil && ttl > time.Minute*59 && ttl <= time.Hour)
+			ttl, err = tx.TTL("key:0001")
+			assert.Assert(err == nil && ttl < 0)
+			var first string
+			err = tx.Ascend("vals", func(key, val string) bool {
+				first = key
+				return false
+			})
+			assert.Assert(err == nil && first == "key:0999")
+			return nil
+		}) == nil)
+	}
+	db = testReOpen(t, db)
+	check(db)
+	data, err := ioutil.ReadFile("data.db")
+	assert.Assert(err == nil && bytes.HasPrefix(data, []byte(snapshotMagic)))
+
+	// save and load the same format
+	var buf bytes.Buffer
+	assert.Assert(db.ReadConfig(&config) == nil)
+	config.SnapshotFormat = BinarySnapshot
+	assert.Assert(db.SetConfig(config) == nil)
+	assert.Assert(db.Save(&buf) == nil)
+	assert.Assert(bytes.HasPrefix(buf.Bytes(), []byte(snapshotMagic)))
+	mdb, err := Open(":memory:")
+	assert.Assert(err == nil)
+	defer mdb.Close()
+	assert.Assert(mdb.Load(bytes.NewReader(buf.Bytes())) == nil)
+	check(mdb)
+
+	// a corrupt snapshot must not load
+	snap := buf.Bytes()
+	snap[len(snap)/2] ^= 0xFF
+	mdb2, err := Open(":memory:")
+	assert.Assert(err == nil)
+	defer mdb2.Close()
+	assert.Assert(mdb2.Load(bytes.NewReader(snap)) == ErrInvalid)
+	assert.Assert(mdb2.Load(bytes.NewReader(snap[:len(snap)-3])) == ErrInvalid)
+	// nothing is loaded from a snapshot whose checksum does not match.
+	snap = append([]byte(nil), buf.Bytes()...)
+	snap[len(snap)-1] ^= 0xFF
+	assert.Assert(mdb2.Load(bytes.NewReader(snap)) == ErrInvalid)
+	assert.Assert(mdb2.View(func(tx *Tx) error {
+		n, err := tx.Len()
+		assert.Assert(err == nil && n == 0)
+		return nil
+	}) == nil)
+	store := NewMemoryStorage()
+	_, err = store.Append(snap)
+	assert.Assert(err == nil)
+	for i := 0; i < 2; i++ {
+		fdb, err := OpenWithOptions("", Options{Storage: store,
+			Recovery: RecoverTruncate})
+		assert.Assert(err == nil)
+		assert.Assert(fdb.View(func(tx *Tx) error {
+			n, err := tx.Len()
+			assert.Assert(err == nil && n == 0)
+			return nil
+		}) == nil)
+		assert.Assert(fdb.Close() == nil)
+		size, err := store.Size()
+		assert.Assert(err == nil && size == 0)
+	}
+}
+
+func TestChecksumRecovery(t *testing.T) {
+	os.RemoveAll("data.db")
+	defer os.RemoveAll("data.db")
+	write := func() {
+		t.Helper()
+		os.RemoveAll("data.db")
+		db, err := OpenWithOptions("data.db", Options{Checksum: true})
+		assert.Assert(err == nil)
+		for i := 1; i <= 3; i++ {
+			assert.Assert(db.Update(func(tx *Tx) error {
+				_, _, err := tx.Set(fmt.Sprintf("key%d", i),
+					fmt.Sprintf("val%d", i), nil)
+				return err
+			}) == nil)
+		}
+		assert.Assert(db.Close() == nil)
+		data, err := ioutil.ReadFile("data.db")
+		assert.Assert(err == nil)
+		assert.Assert(bytes.Count(data, []byte(beginRecord)) == 3)
+		data[bytes.Index(data, []byte("val2"))+3] = 'X'
+		assert.Assert(ioutil.WriteFile("data.db", data, 0666) == nil)
+	}
+	keys := func(db *DB) string {
+		var keys []string
+		assert.Assert(db.View(func(tx *Tx) error {
+			return tx.Ascend("", func(key, val string) bool {
+				keys = append(keys, key)
+				return true
+			})
+		}) == nil)
+		return strings.Join(keys, ",")
+	}
+
+	write()
+	_, err := Open("data.db")
+	assert.Assert(err == ErrChecksum)
+
+	db, err := OpenWithOptions("data.db", Options{Recovery: RecoverTruncate})
+	assert.Assert(err == nil)
+	assert.Assert(keys(db) == "key1")
+	report := db.RecoveryReport()
+	assert.Assert(len(report.Lost) == 1)
+	assert.Assert(report.Lost[0].Err == ErrChecksum && report.Lost[0].Truncated)
+	assert.Assert(db.Close() == nil)
+	fi, err := os.Stat("data.db")
+	assert.Assert(err == nil && fi.Size() == report.Lost[0].Offset)
+
+	write()
+	db, err = OpenWithOptions("data.db", Options{Recovery: RecoverSkip})
+	assert.Assert(err == nil)
+	assert.Assert(keys(db) == "key1,key3")
+	report = db.RecoveryReport()
+	assert.Assert(len(report.Lost) == 1)
+	assert.Assert(report.Lost[0].Err == ErrChecksum && !report.Lost[0].Truncated)
+	assert.Assert(db.Close() == nil)
+
+	// a transaction that was not completely written is never loaded
+	f, err := os.OpenFile("data.db", os.O_APPEND|os.O_WRONLY, 0666)
+	assert.Assert(err == nil)
+	_, err = f.WriteString(beginRecord +
+		"*3\r\n$3\r\nset\r\n$4\r\nkey4\r\n$4\r\nval4\r\n")
+	assert.Assert(err == nil)
+	assert.Assert(f.Close() == nil)
+	db, err = OpenWithOptions("data.db", Options{Recovery: RecoverSkip})
+	assert.Assert(err == nil)
+	defer db.Close()
+	assert.Assert(keys(db) == "key1,key3")
+	report = db.RecoveryReport()
+	assert.Assert(len(report.Lost) == 2)
+	assert.Assert(report.Lost[1].Err == io.ErrUnexpectedEOF && report.Lost[1].Truncated)
+}
+
+func TestRecoverSkipValue(t *testing.T) {
+	os.RemoveAll("data.db")
+	defer os.RemoveAll("data.db")
+	// a value that looks like a transaction without a checksum.
+	crafted := "hello" + beginRecord +
+		"*3\r\n$3\r\nset\r\n$5\r\nadmin\r\n$4\r\ntrue\r\n" +
+		"*1\r\n$6\r\ncommit\r\n"
+	opts := Options{Checksum: true, Recovery: RecoverSkip}
+	db, err := OpenWithOptions("data.db", opts)
+	assert.Assert(err == nil)
+	for i, val := range []string{"val1", crafted, "val3"} {
+		assert.Assert(db.Update(func(tx *Tx) error {
+			_, _, err := tx.Set(fmt.Sprintf("key%d", i+1), val, nil)
+			return err
+		}) == nil)
+	}
+	assert.Assert(db.Close() == nil)
+	// corrupt the transaction with the value, before the value.
+	data, err := ioutil.ReadFile("data.db")
+	assert.Assert(err == nil)
+	data[bytes.Index(data, []byte("hello"))] = 'j'
+	assert.Assert(ioutil.WriteFile("data.db", data, 0666) == nil)
+
+	db, err = OpenWithOptions("data.db", opts)
+	assert.Assert(err == nil)
+	assert.Assert(db.View(func(tx *Tx) error {
+		_, err := tx.Get("admin")
+		assert.Assert(err == ErrNotFound)
+		_, err = tx.Get("key2")
+		assert.Assert(err == ErrNotFound)
+		val, err := tx.Get("key3")
+		assert.Assert(err == nil && val == "val3")
+		return nil
+	}) == nil)
+	report := db.RecoveryReport()
+	assert.Assert(len(report.Lost) == 1)
+	assert.Assert(report.Lost[0].Err == ErrChecksum)
+	assert.Assert(report.Lost[0].Offset+report.Lost[0].Size ==
+		int64(bytes.LastIndex(data, []byte(beginRecord))))
+
+	// a transaction without a checksum is corrupt with the Checksum option.
+	assert.Assert(db.Update(func(tx *Tx) error {
+		return tx.DeleteAll()
+	}) == nil)
+	_, err = db.file.Append([]byte(beginRecord +
+		"*3\r\n$3\r\nset\r\n$5\r\nadmin\r\n$4\r\ntrue\r\n" +
+		"*1\r\n$6\r\ncommit\r\n"))
+	assert.Assert(err == nil)
+	assert.Assert(db.Close() == nil)
+	_, err = OpenWithOptions("data.db", Options{Checksum: true})
+	assert.Assert(err == ErrChecksum)
+}
+
+func TestCommitOrder(t *testing.T) {
+	os.RemoveAll("data.db")
+	defer os.RemoveAll("data.db")
+	db, err := Open("data.db")
+	assert.Assert(err == nil)
+	assert.Assert(db.Update(func(tx *Tx) error {
+		for _, key := range []string{"c", "a", "b"} {
+			if _, _, err := tx.Set(key, key+"1", nil); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.Delete("a"); err != nil {
+			return err
+		}
+		if err := tx.CreateIndexNamed("vals", "*", nil, "string"); err != nil {
+			return err
+		}
+		if err := tx.DeleteAll(); err != nil {
+			return err
+		}
+		if _, _, err := tx.Set("z", "z1", nil); err != nil {
+			return err
+		}
+		_, _, err := tx.Set("a", "a2", nil)
+		return err
+	}) == nil)
+	assert.Assert(db.Close() == nil)
+	data, err := ioutil.ReadFile("data.db")
+	assert.Assert(err == nil)
+	expect := "" +
+		"*1\r\n$5\r\nbegin\r\n" +
+		"*2\r\n$3\r\nseq\r\n$1\r\n1\r\n" +
+		"*5\r\n$5\r\nindex\r\n$4\r\nvals\r\n$1\r\n*\r\n$0\r\n\r\n$6\r\nstring\r\n" +
+		"*1\r\n$7\r\nflushdb\r\n" +
+		"*3\r\n$3\r\nset\r\n$1\r\nz\r\n$2\r\nz1\r\n" +
+		"*3\r\n$3\r\nset\r\n$1\r\na\r\n$2\r\na2\r\n" +
+		"*1\r\n$6\r\ncommit\r\n"
+	assert.Assert(string(data) == expect)
+	db, err = Open("data.db")
+	assert.Assert(err == nil)
+	defer db.Close()
+	assert.Assert(db.View(func(tx *Tx) error {
+		n, err := tx.Len()
+		assert.Assert(err == nil && n == 2)
+		val, err := tx.Get("a")
+		assert.Assert(err == nil && val == "a2")
+		return nil
+	}) == nil)
+}
+
+func TestAbsoluteExpiration(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	exat := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	assert.Assert(db.Update(func(tx *Tx) error {
+		_, _, err := tx.Set("key", "val", &SetOptions{Expires: true,
+			TTL: time.Until(exat)})
+		return err
+	}) == nil)
+	check := func(db *DB) {
+		t.Helper()
+		var val string
+		var ttl time.Duration
+		assert.Assert(db.View(func(tx *Tx) error {
+			var err error
+			val, err = tx.Get("key")
+			if err != nil {
+				return err
+			}
+			ttl, err = tx.TTL("key")
+			return err
+		}) == nil)
+		assert.Assert(val == "val")
+		assert.Assert(ttl > 59*time.Minute && ttl <= time.Until(exat)+time.Millisecond)
+	}
+	// the modification time of the file must not matter
+	old := time.Now().Add(-time.Hour * 24)
+	db = testReOpen(t, db)
+	check(db)
+	assert.Assert(os.Chtimes("data.db", old, old) == nil)
+	db = testReOpen(t, db)
+	check(db)
+	assert.Assert(db.Shrink() == nil)
+	assert.Assert(os.Chtimes("data.db", old, old) == nil)
+	db = testReOpen(t, db)
+	check(db)
+	data, err := ioutil.ReadFile("data.db")
+	assert.Assert(err == nil)
+	assert.Assert(strings.Contains(string(data), "$4\r\npxat\r\n"))
+}
+
+func TestSubSecondTTL(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	expired := make(chan time.Time, 1)
+	assert.Assert(db.SetConfig(Config{
+		SyncPolicy:           EverySecond,
+		AutoShrinkPercentage: 100,
+		AutoShrinkMinSize:    32 * 1024 * 1024,
+		OnExpired: func(keys []string) {
+			if len(keys) == 1 && keys[0] == "key1" {
+				expired <- time.Now()
+			}
+		},
+	}) == nil)
+	start := time.Now()
+	assert.Assert(db.Update(func(tx *Tx) error {
+		_, _, err := tx.Set("key1", "val1",
+			&SetOptions{Expires: true, TTL: time.Millisecond * 100})
+		return err
+	}) == nil)
+	select {
+	case at := <-expired:
+		// the background manager must wake up for the expiration, rather
+		// than on the next one second tick.
+		assert.Assert(at.Sub(start) >= time.Millisecond*100)
+		assert.Assert(at.Sub(start) < time.Millisecond*700)
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+
+	// the ttl must survive a reopen with millisecond precision.
+	assert.Assert(db.SetConfig(Config{SyncPolicy: EverySecond}) == nil)
+	assert.Assert(db.Update(func(tx *Tx) error {
+		_, _, err := tx.Set("key2", "val2",
+			&SetOptions{Expires: true, TTL: time.Millisecond * 500})
+		return err
+	}) == nil)
+	db = testReOpen(t, db)
+	var ttl time.Duration
+	assert.Assert(db.View(func(tx *Tx) error {
+		var err error
+		ttl, err = tx.TTL("key2")
+		return err
+	}) == nil)
+	assert.Assert(ttl > 0 && ttl <= time.Millisecond*500)
+	time.Sleep(ttl + time.Millisecond*50)
+	assert.Assert(db.View(func(tx *Tx) error {
+		_, err := tx.Get("key2")
+		return err
+	}) == ErrNotFound)
+}
+
+func TestConditionalWrites(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	get := func(key string) string {
+		t.Helper()
+		var val string
+		assert.Assert(db.View(func(tx *Tx) error {
+			var err error
+			val, err = tx.Get(key)
+			if err == ErrNotFound {
+				val, err = "<nil>", nil
+			}
+			return err
+		}) == nil)
+		return val
+	}
+	assert.Assert(db.Update(func(tx *Tx) error {
+		assert.Assert(tx.SetNX("key1", "val1", nil) == nil)
+		assert.Assert(tx.SetNX("key1", "val2", nil) == ErrConditionFailed)
+		_, err := tx.SetXX("key2", "val2", nil)
+		assert.Assert(err == ErrConditionFailed)
+		prev, err := tx.SetXX("key1", "val3", nil)
+		assert.Assert(err == nil && prev == "val1")
+		assert.Assert(tx.CompareAndSwap("key1", "val1", "val4", nil) ==
+			ErrConditionFailed)
+		assert.Assert(tx.CompareAndSwap("key2", "", "val4", nil) ==
+			ErrConditionFailed)
+		assert.Assert(tx.CompareAndSwap("key1", "val3", "val4", nil) == nil)
+		assert.Assert(tx.CompareAndDelete("key1", "val3") == ErrConditionFailed)
+		assert.Assert(tx.SetNX("key2", "val2", nil) == nil)
+		assert.Assert(tx.CompareAndDelete("key2", "val2") == nil)
+		// expired items are treated as absent
+		_, _, err = tx.Set("key3", "val3",
+			&SetOptions{Expires: true, TTL: -time.Second})
+		assert.Assert(err == nil)
+		_, err = tx.SetXX("key3", "val3", nil)
+		assert.Assert(err == ErrConditionFailed)
+		assert.Assert(tx.SetNX("key3", "val5", nil) == nil)
+		return nil
+	}) == nil)
+	assert.Assert(get("key1") == "val4")
+	assert.Assert(get("key2") == "<nil>")
+	assert.Assert(get("key3") == "val5")
+
+	// conditional writes are rolled back
+	assert.Assert(db.Update(func(tx *Tx) error {
+		assert.Assert(tx.CompareAndSwap("key1", "val4", "val6", nil) == nil)
+		assert.Assert(tx.CompareAndDelete("key3", "val5") == nil)
+		assert.Assert(tx.SetNX("key2", "val2", nil) == nil)
+		return errors.New("rollback")
+	}).Error() == "rollback")
+	assert.Assert(get("key1") == "val4")
+	assert.Assert(get("key2") == "<nil>")
+	assert.Assert(get("key3") == "val5")
+
+	// and persisted
+	db = testReOpen(t, db)
+	assert.Assert(get("key1") == "val4")
+	assert.Assert(get("key2") == "<nil>")
+	assert.Assert(get("key3") == "val5")
+
+	assert.Assert(db.View(func(tx *Tx) error {
+		return tx.SetNX("key4", "val4", nil)
+	}) == ErrTxNotWritable)
+}
+
+func TestVersions(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	version := func(key string) uint64 {
+		t.Helper()
+		var version uint64
+		assert.Assert(db.View(func(tx *Tx) error {
+			var err error
+			_, version, err = tx.GetWithVersion(key)
+			if err == ErrNotFound {
+				err = nil
+			}
+			return err
+		}) == nil)
+		return version
+	}
+	set := func(keys ...string) {
+		t.Helper()
+		assert.Assert(db.Update(func(tx *Tx) error {
+			for _, key := range keys {
+				if _, _, err := tx.Set(key, "val", nil); err != nil {
+					return err
+				}
+			}
+			return nil
+		}) == nil)
+	}
+	set("key1", "key2")
+	set("key3")
+	assert.Assert(version("key1") == 1 && version("key2") == 1)
+	assert.Assert(version("key3") == 2)
+	assert.Assert(version("key4") == 0)
+
+	// transactions without changes, or that are rolled back, do not use
+	// a sequence.
+	assert.Assert(db.Update(func(tx *Tx) error { return nil }) == nil)
+	assert.Assert(db.Update(func(tx *Tx) error {
+		_, _, err := tx.Set("key4", "val", nil)
+		assert.Assert(err == nil)
+		return errors.New("rollback")
+	}) != nil)
+	set("key4")
+	assert.Assert(version("key4") == 3)
+
+	assert.Assert(db.Update(func(tx *Tx) error {
+		assert.Assert(tx.SetIfVersion("key1", "val2", 2, nil) ==
+			ErrConditionFailed)
+		assert.Assert(tx.SetIfVersion("key5", "val2", 1, nil) ==
+			ErrConditionFailed)
+		assert.Assert(tx.SetIfVersion("key1", "val2", 1, nil) == nil)
+		return tx.SetIfVersion("key5", "val2", 0, nil)
+	}) == nil)
+	assert.Assert(version("key1") == 4 && version("key5") == 4)
+
+	// versions are restored when the database is loaded
+	check := func() {
+		t.Helper()
+		assert.Assert(version("key1") == 4 && version("key2") == 1)
+		assert.Assert(version("key3") == 2 && version("key4") == 3)
+		set("key6")
+		assert.Assert(version("key6") == 5)
+		assert.Assert(db.Update(func(tx *Tx) error {
+			_, err := tx.Delete("key6")
+			return err
+		}) == nil)
+	}
+	db = testReOpen(t, db)
+	check()
+	db = testReOpen(t, db)
+	assert.Assert(version("key6") == 0)
+	assert.Assert(db.Shrink() == nil)
+	db = testReOpen(t, db)
+	assert.Assert(version("key1") == 4 && version("key2") == 1)
+	set("key6")
+	assert.Assert(version("key6") == 7)
+	assert.Assert(db.SetConfig(Config{SnapshotFormat: BinarySnapshot}) == nil)
+	assert.Assert(db.Shrink() == nil)
+	db = testReOpen(t, db)
+	assert.Assert(version("key1") == 4 && version("key6") == 7)
+	set("key7")
+	assert.Assert(version("key7") == 8)
+
+	// items in older files get increasing versions
+	assert.Assert(db.Close() == nil)
+	assert.Assert(ioutil.WriteFile("data.db", []byte(
+		"*3\r\n$3\r\nset\r\n$4\r\nkey1\r\n$3\r\nval\r\n"+
+			"*3\r\n$3\r\nset\r\n$4\r\nkey2\r\n$3\r\nval\r\n"), 0666) == nil)
+	db = testReOpen(t, nil)
+	assert.Assert(version("key1") == 1 && version("key2") == 2)
+}
+
+func TestIncr(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	assert.Assert(db.Update(func(tx *Tx) error {
+		if err := tx.CreateIndexNamed("counters", "*", nil, "int"); err != nil {
+			return err
+		}
+		n, err := tx.Incr("a")
+		assert.Assert(err == nil && n == 1)
+		n, err = tx.IncrBy("a", 10)
+		assert.Assert(err == nil && n == 11)
+		n, err = tx.Decr("b")
+		assert.Assert(err == nil && n == -1)
+		_, _, err = tx.Set("c", "5", &SetOptions{Expires: true, TTL: time.Hour})
+		assert.Assert(err == nil)
+		n, err = tx.IncrBy("c", -10)
+		assert.Assert(err == nil && n == -5)
+		ttl, err := tx.TTL("c")
+		assert.Assert(err == nil && ttl > 59*time.Minute)
+		_, _, err = tx.Set("d", "hello", nil)
+		assert.Assert(err == nil)
+		_, err = tx.Incr("d")
+		assert.Assert(err == ErrNotNumeric)
+		_, err = tx.IncrByFloat("d", 1)
+		assert.Assert(err == ErrNotNumeric)
+		_, _, err = tx.Set("e", strconv.FormatInt(math.MaxInt64, 10), nil)
+		assert.Assert(err == nil)
+		_, err = tx.Incr("e")
+		assert.Assert(err == ErrInvalidOperation)
+		f, err := tx.IncrByFloat("f", 1.5)
+		assert.Assert(err == nil && f == 1.5)
+		f, err = tx.IncrByFloat("f", 0.25)
+		assert.Assert(err == nil && f == 1.75)
+		_, err = tx.Incr("f")
+		assert.Assert(err == ErrNotNumeric)
+		_, err = tx.Delete("d")
+		return err
+	}) == nil)
+	db = testReOpen(t, db)
+	assert.Assert(db.View(func(tx *Tx) error {
+		var keys []string
+		err := tx.Ascend("counters", func(key, val string) bool {
+			keys = append(keys, key+"="+val)
+			return true
+		})
+		assert.Assert(err == nil)
+		assert.Assert(strings.Join(keys, ",") ==
+			"c=-5,b=-1,f=1.75,a=11,e=9223372036854775807")
+		ttl, err := tx.TTL("c")
+		assert.Assert(err == nil && ttl > 59*time.Minute)
+		return nil
+	}) == nil)
+	assert.Assert(db.View(func(tx *Tx) error {
+		_, err := tx.Incr("a")
+		return err
+	}) == ErrTxNotWritable)
+}
+
+func TestSnapshotIsolation(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	assert.Assert(db.Update(func(tx *Tx) error {
+		if err := tx.CreateIndex("vals", "*", IndexString); err != nil {
+			return err
+		}
+		if err := tx.CreateSpatialIndex("pts", "pt:*", IndexRect); err != nil {
+			return err
+		}
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("key:%03d", i)
+			if _, _, err := tx.Set(key, key, nil); err != nil {
+				return err
+			}
+		}
+		_, _, err := tx.Set("pt:1", "[1 1]", nil)
+		return err
+	}) == nil)
+	// open a read-only transaction and keep it open while writing.
+	rtx, err := db.Begin(false)
+	assert.Assert(err == nil)
+	done := make(chan error)
+	go func() {
+		done <- db.Update(func(tx *Tx) error {
+			if err := tx.DeleteAll(); err != nil {
+				return err
+			}
+			_, _, err := tx.Set("pt:2", "[2 2]", nil)
+			return err
+		})
+	}()
+	select {
+	case err := <-done:
+		assert.Assert(err == nil)
+	case <-time.After(time.Second * 5):
+		t.Fatal("update was blocked by a read-only transaction")
+	}
+	// the read-only transaction still sees the earlier version.
+	n, err := rtx.Len()
+	assert.Assert(err == nil && n == 101)
+	val, err := rtx.Get("key:050")
+	assert.Assert(err == nil && val == "key:050")
+	var count int
+	assert.Assert(rtx.Ascend("vals", func(key, val string) bool {
+		count++
+		return true
+	}) == nil)
+	assert.Assert(count == 101)
+	var pts []string
+	assert.Assert(rtx.Intersects("pts", "[-10 -10],[10 10]",
+		func(key, val string) bool {
+			pts = append(pts, key)
+			return true
+		}) == nil)
+	assert.Assert(strings.Join(pts, ",") == "pt:1")
+	assert.Assert(rtx.Rollback() == nil)
+	// a new read-only transaction sees the latest version.
+	assert.Assert(db.View(func(tx *Tx) error {
+		n, err := tx.Len()
+		assert.Assert(err == nil && n == 1)
+		_, err = tx.Get("key:050")
+		assert.Assert(err == ErrNotFound)
+		var pts []string
+		assert.Assert(tx.Intersects("pts", "[-10 -10],[10 10]",
+			func(key, val string) bool {
+				pts = append(pts, key)
+				return true
+			}) == nil)
+		assert.Assert(strings.Join(pts, ",") == "pt:2")
+		return nil
+	}) == nil)
+	// a read-only transaction can begin while a writer is in progress.
+	wtx, err := db.Begin(true)
+	assert.Assert(err == nil)
+	_, _, err = wtx.Set("pt:3", "[3 3]", nil)
+	assert.Assert(err == nil)
+	assert.Assert(db.View(func(tx *Tx) error {
+		_, err := tx.Get("pt:3")
+		assert.Assert(err == ErrNotFound)
+		return nil
+	}) == nil)
+	assert.Assert(wtx.Commit() == nil)
+	assert.Assert(db.View(func(tx *Tx) error {
+		_, err := tx.Get("pt:3")
+		return err
+	}) == nil)
+}
+
+func TestSpatialVersions(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	assert.Assert(db.Update(func(tx *Tx) error {
+		return tx.CreateSpatialIndex("pts", "pt:*", IndexRect)
+	}) == nil)
+	set := func(key, val string) {
+		assert.Assert(db.Update(func(tx *Tx) error {
+			if val == "" {
+				_, err := tx.Delete(key)
+				return err
+			}
+			_, _, err := tx.Set(key, val, nil)
+			return err
+		}) == nil)
+	}
+	intersects := func(tx *Tx) string {
+		var pts []string
+		assert.Assert(tx.Intersects("pts", "[-10 -10],[10 10]",
+			func(key, val string) bool {
+				pts = append(pts, key)
+				return true
+			}) == nil)
+		sort.Strings(pts)
+		return strings.Join(pts, ",")
+	}
+	view := func() (pts string) {
+		assert.Assert(db.View(func(tx *Tx) error {
+			pts = intersects(tx)
+			return nil
+		}) == nil)
+		return pts
+	}
+	// the changes of every commit are made to the published version.
+	set("pt:1", "[1 1]")
+	set("pt:2", "[2 2]")
+	set("pt:3", "[3 3]")
+	set("pt:2", "[20 20]")
+	set("pt:3", "")
+	assert.Assert(view() == "pt:1")
+	// a pinned version is not changed by later commits.
+	rtx, err := db.Begin(false)
+	assert.Assert(err == nil)
+	set("pt:4", "[4 4]")
+	set("pt:1", "")
+	set("pt:5", "[5 5]")
+	assert.Assert(intersects(rtx) == "pt:1")
+	assert.Assert(rtx.Rollback() == nil)
+	assert.Assert(view() == "pt:4,pt:5")
+	set("pt:2", "[2 2]")
+	assert.Assert(view() == "pt:2,pt:4,pt:5")
+	// rolled back changes are not published.
+	assert.Assert(db.Update(func(tx *Tx) error {
+		if _, _, err := tx.Set("pt:6", "[6 6]", nil); err != nil {
+			return err
+		}
+		if _, err := tx.Delete("pt:2"); err != nil {
+			return err
+		}
+		return errors.New("rollback")
+	}) != nil)
+	set("pt:7", "[7 7]")
+	assert.Assert(view() == "pt:2,pt:4,pt:5,pt:7")
+	// the rtree of a version is reused once it's no longer pinned, while
+	// the versions that are still pinned are not changed.
+	tx1, err := db.Begin(false)
+	assert.Assert(err == nil)
+	set("pt:8", "[8 8]")
+	tx2, err := db.Begin(false)
+	assert.Assert(err == nil)
+	set("pt:2", "")
+	set("pt:9", "[9 9]")
+	assert.Assert(intersects(tx1) == "pt:2,pt:4,pt:5,pt:7")
+	assert.Assert(tx1.Rollback() == nil)
+	set("pt:4", "")
+	tx3, err := db.Begin(false)
+	assert.Assert(err == nil)
+	set("pt:5", "")
+	assert.Assert(intersects(tx2) == "pt:2,pt:4,pt:5,pt:7,pt:8")
+	assert.Assert(intersects(tx3) == "pt:5,pt:7,pt:8,pt:9")
+	assert.Assert(tx2.Rollback() == nil)
+	assert.Assert(tx3.Rollback() == nil)
+	set("pt:1", "[1 1]")
+	assert.Assert(view() == "pt:1,pt:7,pt:8,pt:9")
+}
+
+func TestOptimistic(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	// many writers on the same and on disjoint keys.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				assert.Assert(db.UpdateOptimistic(func(tx *Tx) error {
+					if _, err := tx.Incr("shared"); err != nil {
+						return err
+					}
+					_, err := tx.Incr(fmt.Sprintf("own:%d", i))
+					return err
+				}) == nil)
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.Assert(db.View(func(tx *Tx) error {
+		val, err := tx.Get("shared")
+		assert.Assert(err == nil && val == "800")
+		for i := 0; i < 8; i++ {
+			val, err := tx.Get(fmt.Sprintf("own:%d", i))
+			assert.Assert(err == nil && val == "100")
+		}
+		return nil
+	}) == nil)
+
+	// changes are private until commit.
+	tx1, err := db.BeginOptimistic()
+	assert.Assert(err == nil)
+	_, _, err = tx1.Set("a", "1", nil)
+	assert.Assert(err == nil)
+	val, err := tx1.Get("a")
+	assert.Assert(err == nil && val == "1")
+	assert.Assert(db.View(func(tx *Tx) error {
+		_, err := tx.Get("a")
+		assert.Assert(err == ErrNotFound)
+		return nil
+	}) == nil)
+	// a commit on a disjoint key does not conflict.
+	assert.Assert(db.Update(func(tx *Tx) error {
+		_, _, err := tx.Set("b", "2", nil)
+		return err
+	}) == nil)
+	assert.Assert(tx1.Commit() == nil)
+
+	// a commit on a key that was read conflicts.
+	tx1, err = db.BeginOptimistic()
+	assert.Assert(err == nil)
+	_, err = tx1.Get("b")
+	assert.Assert(err == nil)
+	_, _, err = tx1.Set("c", "3", nil)
+	assert.Assert(err == nil)
+	assert.Assert(db.Update(func(tx *Tx) error {
+		_, err := tx.Delete("b")
+		return err
+	}) == nil)
+	assert.Assert(tx1.Commit() == ErrConflict)
+	assert.Assert(tx1.Commit() == ErrTxClosed)
+
+	// a commit on a key in a range that was iterated over conflicts.
+	tx1, err = db.BeginOptimistic()
+	assert.Assert(err == nil)
+	assert.Assert(tx1.AscendRange("", "x", "y", func(key, val string) bool {
+		return true
+	}) == nil)
+	_, _, err = tx1.Set("d", "4", nil)
+	assert.Assert(err == nil)
+	assert.Assert(db.Update(func(tx *Tx) error {
+		_, _, err := tx.Set("z", "26", nil)
+		return err
+	}) == nil)
+	tx2, err := db.BeginOptimistic()
+	assert.Assert(err == nil)
+	_, _, err = tx2.Set("x1", "5", nil)
+	assert.Assert(err == nil)
+	assert.Assert(tx2.Commit() == nil)
+	assert.Assert(tx1.Commit() == ErrConflict)
+
+	// indexes cannot be changed.
+	assert.Assert(db.UpdateOptimistic(func(tx *Tx) error {
+		return tx.CreateIndex("idx", "*", IndexString)
+	}) == ErrInvalidOperation)
+
+	// a rollback makes no changes.
+	tx1, err = db.BeginOptimistic()
+	assert.Assert(err == nil)
+	assert.Assert(tx1.DeleteAll() == nil)
+	n, err := tx1.Len()
+	assert.Assert(err == nil && n == 0)
+	assert.Assert(tx1.Rollback() == nil)
+
+	db = testReOpen(t, db)
+	assert.Assert(db.View(func(tx *Tx) error {
+		var keys []string
+		err := tx.Ascend("", func(key, val string) bool {
+			if !strings.HasPrefix(key, "own:") {
+				keys = append(keys, key+"="+val)
+			}
+			return true
+		})
+		assert.Assert(err == nil)
+		assert.Assert(strings.Join(keys, ",") == "a=1,shared=800,x1=5,z=26")
+		return nil
+	}) == nil)
+	assert.Assert(len(db.commits) == 0 && len(db.active) == 0)
+}
+
+func TestGroupSync(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	var config Config
+	assert.Assert(db.ReadConfig(&config) == nil)
+	config.SyncPolicy = Always
+	assert.Assert(db.SetConfig(config) == nil)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				assert.Assert(db.UpdateOptimistic(func(tx *Tx) error {
+					_, _, err := tx.Set(fmt.Sprintf("%d:%d", i, j), "val", nil)
+					return err
+				}) == nil)
+			}
+		}(i)
+	}
+	wg.Wait()
+	db.gsync.mu.Lock()
+	assert.Assert(db.gsync.written == 400 && db.gsync.synced == 400)
+	db.gsync.mu.Unlock()
+	db = testReOpen(t, db)
+	assert.Assert(db.View(func(tx *Tx) error {
+		n, err := tx.Len()
+		assert.Assert(err == nil && n == 400)
+		return nil
+	}) == nil)
+}
+
+func TestPeriodicSync(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	assert.Assert(db.SetConfig(Config{SyncPolicy: Periodic}) ==
+		ErrInvalidSyncPolicy)
+	assert.Assert(db.SetConfig(Config{SyncPolicy: Periodic,
+		SyncCommits: -1}) == ErrInvalidSyncPolicy)
+	assert.Assert(db.SetConfig(Config{SyncPolicy: Periodic,
+		SyncCommits: 10, SyncBytes: 1024 * 1024}) == nil)
+	set := func(i int) {
+		assert.Assert(db.Update(func(tx *Tx) error {
+			_, _, err := tx.Set(fmt.Sprintf("key:%d", i), "val", nil)
+			return err
+		}) == nil)
+	}
+	synced := func() uint64 {
+		db.gsync.mu.Lock()
+		defer db.gsync.mu.Unlock()
+		return db.gsync.synced
+	}
+	for i := 0; i < 25; i++ {
+		set(i)
+	}
+	assert.Assert(synced() == 2)
+	// the bytes threshold
+	assert.Assert(db.SetConfig(Config{SyncPolicy: Periodic,
+		SyncBytes: 200}) == nil)
+	for i := 0; i < 10; i++ {
+		set(i)
+	}
+	assert.Assert(synced() > 2)
+	// the interval
+	assert.Assert(db.SetConfig(Config{SyncPolicy: Periodic,
+		SyncInterval: time.Millisecond * 50}) == nil)
+	set(0)
+	time.Sleep(time.Millisecond * 200)
+	db.RLock()
+	unsynced := db.unsyncedTxs
+	db.RUnlock()
+	assert.Assert(unsynced == 0)
+}
+
+func TestContext(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	assert.Assert(db.Update(func(tx *Tx) error {
+		for i := 0; i < 1000; i++ {
+			_, _, err := tx.Set(fmt.Sprintf("key:%04d", i), "val", nil)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}) == nil)
+	// give up waiting on another writer.
+	tx, err := db.Begin(true)
+	assert.Assert(err == nil)
+	ctx, cancel := context.WithTimeout(context.Background(),
+		time.Millisecond*50)
+	err = db.UpdateContext(ctx, func(tx *Tx) error {
+		t.Fatal("should not be called")
+		return nil
+	})
+	cancel()
+	assert.Assert(err == context.DeadlineExceeded)
+	// readers do not wait.
+	assert.Assert(db.ViewContext(ctx, func(tx *Tx) error {
+		_, err := tx.Get("key:0001")
+		return err
+	}) == nil)
+	assert.Assert(tx.Rollback() == nil)
+	// the lock is not held by the canceled transaction.
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	assert.Assert(db.UpdateContext(ctx, func(tx *Tx) error {
+		_, _, err := tx.Set("a", "b", nil)
+		return err
+	}) == nil)
+	cancel()
+	// a scan stops when the context is canceled.
+	ctx, cancel = context.WithCancel(context.Background())
+	var n int
+	err = db.ViewContext(ctx, func(tx *Tx) error {
+		return tx.Ascend("", func(key, val string) bool {
+			n++
+			if n == 10 {
+				cancel()
+			}
+			return true
+		})
+	})
+	assert.Assert(err == context.Canceled && n == 10)
+	_, err = db.BeginContext(ctx, true)
+	assert.Assert(err == context.Canceled)
+}
+
+func TestSubscribe(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	all, err := db.Subscribe("*")
+	assert.Assert(err == nil)
+	users, err := db.Subscribe("user:*")
+	assert.Assert(err == nil)
+	assert.Assert(db.Update(func(tx *Tx) error {
+		tx.Set("user:1", "a", nil)
+		tx.Set("item:1", "b", nil)
+		tx.Set("user:1", "c", nil)
+		return nil
+	}) == nil)
+	// a rolled back transaction has no events.
+	assert.Assert(db.Update(func(tx *Tx) error {
+		tx.Set("user:2", "d", nil)
+		return errors.New("rollback")
+	}) != nil)
+	assert.Assert(db.Update(func(tx *Tx) error {
+		_, err := tx.Delete("user:1")
+		return err
+	}) == nil)
+	ev := <-users.C
+	assert.Assert(ev.Type == EventSet && ev.Key == "user:1" &&
+		ev.Value == "a" && !ev.HasPrevious && ev.Seq == 1)
+	ev = <-users.C
+	assert.Assert(ev.Type == EventSet && ev.Value == "c" &&
+		ev.HasPrevious && ev.Previous == "a" && ev.Seq == 1)
+	ev = <-users.C
+	assert.Assert(ev.Type == EventDelete && ev.Key == "user:1" &&
+		ev.Previous == "c" && ev.Seq == 2)
+	assert.Assert(len(all.C) == 4)
+	// expired items are removed by the background manager.
+	assert.Assert(db.Update(func(tx *Tx) error {
+		_, _, err := tx.Set("user:3", "e", &SetOptions{Expires: true,
+			TTL: time.Millisecond * 10})
+		return err
+	}) == nil)
+	ev = <-users.C
+	assert.Assert(ev.Type == EventSet && ev.Key == "user:3")
+	select {
+	case ev = <-users.C:
+		assert.Assert(ev.Type == EventExpire && ev.Key == "user:3" &&
+			ev.HasPrevious && ev.Previous == "e")
+	case <-time.After(time.Second * 5):
+		t.Fatal("expected an expire event")
+	}
+	assert.Assert(db.Update(func(tx *Tx) error {
+		return tx.DeleteAll()
+	}) == nil)
+	ev = <-users.C
+	assert.Assert(ev.Type == EventFlush && ev.Key == "")
+	assert.Assert(users.Close() == nil)
+	_, ok := <-users.C
+	assert.Assert(!ok && users.Err() == nil)
+	// the subscription that is not received from is closed when its buffer
+	// is full.
+	assert.Assert(db.Update(func(tx *Tx) error {
+		for i := 0; i < 1024; i++ {
+			tx.Set(fmt.Sprintf("key:%d", i), "val", nil)
+		}
+		return nil
+	}) == nil)
+	n := 0
+	for range all.C {
+		n++
+	}
+	assert.Assert(n == 1024 && all.Err() == ErrSlowSubscriber)
+	// closing the database closes the subscriptions.
+	sub, err := db.Subscribe("*")
+	assert.Assert(err == nil)
+	assert.Assert(db.Close() == nil)
+	_, ok = <-sub.C
+	assert.Assert(!ok && sub.Err() == ErrDatabaseClosed)
+	_, err = db.Subscribe("*")
+	assert.Assert(err == ErrDatabaseClosed)
+}
+
+// blockingStorage is a storage whose next sync waits until it's released,
+// once it has been blocked.
+type blockingStorage struct {
+	Storage
+	mu      sync.Mutex
+	syncing chan struct{} // receives the blocked sync
+	release chan struct{}
+}
+
+// block blocks the next sync, which is received from syncing once it's
+// waiting, and continues when release is closed.
+func (bs *blockingStorage) block() (syncing, release chan struct{}) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	bs.syncing = make(chan struct{})
+	bs.release = make(chan struct{})
+	return bs.syncing, bs.release
+}
+
+func (bs *blockingStorage) Sync() error {
+	bs.mu.Lock()
+	syncing, release := bs.syncing, bs.release
+	bs.syncing = nil
+	bs.mu.Unlock()
+	if syncing != nil {
+		syncing <- struct{}{}
+		<-release
+	}
+	return bs.Storage.Sync()
+}
+
+func TestSubscribeSynced(t *testing.T) {
+	store := &blockingStorage{Storage: NewMemoryStorage()}
+	db, err := OpenWithOptions("", Options{Storage: store})
+	assert.Assert(err == nil)
+	defer db.Close()
+	assert.Assert(db.SetConfig(Config{SyncPolicy: Always}) == nil)
+	sub, err := db.Subscribe("*")
+	assert.Assert(err == nil)
+	syncing, release := store.block()
+	done := make(chan error)
+	go func() {
+		done <- db.Update(func(tx *Tx) error {
+			_, _, err := tx.Set("key", "val", nil)
+			return err
+		})
+	}()
+	<-syncing
+	// the commit is visible, but its event is not sent before the sync.
+	assert.Assert(db.View(func(tx *Tx) error {
+		val, err := tx.Get("key")
+		assert.Assert(err == nil && val == "val")
+		return nil
+	}) == nil)
+	select {
+	case <-sub.C:
+		t.Fatal("event was sent before the commit was synced")
+	case <-time.After(time.Millisecond * 50):
+	}
+	close(release)
+	assert.Assert(<-done == nil)
+	ev := <-sub.C
+	assert.Assert(ev.Type == EventSet && ev.Key == "key" && ev.Seq == 1)
+}
+
+func TestCommitHooks(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	var committed []Event
+	errNegative := errors.New("negative balance")
+	assert.Assert(db.SetConfig(Config{
+		SyncPolicy: Always,
+		BeforeCommit: func(tx *Tx, changes []Event) error {
+			for _, ev := range changes {
+				if ev.Type == EventSet && strings.HasPrefix(ev.Value, "-") {
+					return errNegative
+				}
+			}
+			// changes that are made by the hook are committed too.
+			_, err := tx.Incr("commits")
+			return err
+		},
+		OnCommit: func(changes []Event) {
+			committed = append(committed, changes...)
+		},
+	}) == nil)
+	assert.Assert(db.Update(func(tx *Tx) error {
+		_, _, err := tx.Set("balance:1", "10", nil)
+		return err
+	}) == nil)
+	assert.Assert(len(committed) == 2)
+	assert.Assert(committed[0].Key == "balance:1" && committed[0].Value == "10")
+	assert.Assert(committed[1].Key == "commits" && committed[1].Value == "1")
+	// the hook vetoes the commit.
+	err := db.Update(func(tx *Tx) error {
+		tx.Set("balance:2", "20", nil)
+		_, _, err := tx.Set("balance:1", "-5", nil)
+		return err
+	})
+	assert.Assert(err == errNegative)
+	assert.Assert(len(committed) == 2)
+	// optimistic transactions are vetoed too.
+	err = db.UpdateOptimistic(func(tx *Tx) error {
+		_, _, err := tx.Set("balance:1", "-5", nil)
+		return err
+	})
+	assert.Assert(err == errNegative)
+	// a read-only transaction or one without changes has no hooks.
+	assert.Assert(db.View(func(tx *Tx) error { return nil }) == nil)
+	assert.Assert(db.Update(func(tx *Tx) error { return nil }) == nil)
+	assert.Assert(len(committed) == 2)
+	assert.Assert(db.View(func(tx *Tx) error {
+		val, err := tx.Get("balance:1")
+		assert.Assert(err == nil && val == "10")
+		_, err = tx.Get("balance:2")
+		assert.Assert(err == ErrNotFound)
+		val, err = tx.Get("commits")
+		assert.Assert(err == nil && val == "1")
+		return nil
+	}) == nil)
+	// the rolled back changes are not in the file.
+	db = testReOpen(t, db)
+	defer testClose(db)
+	assert.Assert(db.View(func(tx *Tx) error {
+		_, err := tx.Get("balance:2")
+		return err
+	}) == ErrNotFound)
+}
+
+func TestReplication(t *testing.T) {
+	primary, err := OpenWithOptions(":memory:", Options{ReplicationBacklog: 256})
+	assert.Assert(err == nil)
+	defer primary.Close()
+	assert.Assert(primary.Update(func(tx *Tx) error {
+		if err := tx.CreateIndexNamed("name", "user:*", nil, "string"); err != nil {
+			return err
+		}
+		for i := 0; i < 10; i++ {
+			tx.Set(fmt.Sprintf("user:%d", i), fmt.Sprintf("name%d", 9-i), nil)
+		}
+		return nil
+	}) == nil)
+	os.RemoveAll("replica.db")
+	defer os.RemoveAll("replica.db")
+	// follow starts replicating to the replica, and returns a func that
+	// stops it.
+	follow := func(replica *DB) func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		c1, c2 := net.Pipe()
+		errs := make(chan error, 2)
+		go func() { errs <- primary.Replicate(ctx, c1) }()
+		go func() { errs <- replica.Follow(ctx, c2) }()
+		return func() {
+			cancel()
+			assert.Assert(<-errs == context.Canceled)
+			assert.Assert(<-errs == context.Canceled)
+		}
+	}
+	caughtUp := func(replica *DB) {
+		var seq uint64
+		primary.View(func(tx *Tx) error {
+			seq = tx.trees().seq
+			return nil
+		})
+		start := time.Now()
+		for replica.ReplicaStatus().Seq != seq {
+			if time.Since(start) > time.Second*5 {
+				t.Fatal("replica did not catch up")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	replica, err := OpenWithOptions("replica.db", Options{Replica: true})
+	assert.Assert(err == nil)
+	// a replica is read-only, and a primary cannot follow.
+	_, err = replica.Begin(true)
+	assert.Assert(err == ErrTxNotWritable)
+	assert.Assert(primary.Follow(context.Background(), nil) ==
+		ErrInvalidOperation)
+	stop := follow(replica)
+	caughtUp(replica)
+	assert.Assert(primary.Update(func(tx *Tx) error {
+		tx.Delete("user:0")
+		_, _, err := tx.Set("user:10", "name", nil)
+		return err
+	}) == nil)
+	caughtUp(replica)
+	status := replica.ReplicaStatus()
+	assert.Assert(status.Connected && status.Lag == 0 && status.Resyncs == 1)
+	var keys []string
+	assert.Assert(replica.View(func(tx *Tx) error {
+		return tx.Ascend("name", func(key, value string) bool {
+			keys = append(keys, key)
+			return true
+		})
+	}) == nil)
+	assert.Assert(len(keys) == 10 && keys[0] == "user:10" &&
+		keys[9] == "user:1")
+	stop()
+	assert.Assert(!replica.ReplicaStatus().Connected)
+	// the replica resumes from its file, without a full copy.
+	assert.Assert(primary.Update(func(tx *Tx) error {
+		_, _, err := tx.Set("user:11", "name", nil)
+		return err
+	}) == nil)
+	assert.Assert(replica.Close() == nil)
+	replica, err = OpenWithOptions("replica.db", Options{Replica: true})
+	assert.Assert(err == nil)
+	defer replica.Close()
+	stop = follow(replica)
+	caughtUp(replica)
+	assert.Assert(replica.ReplicaStatus().Resyncs == 0)
+	stop()
+	// the commits are no longer in the backlog.
+	for i := 0; i < 10; i++ {
+		assert.Assert(primary.Update(func(tx *Tx) error {
+			_, _, err := tx.Set(fmt.Sprintf("user:%d", i),
+				strings.Repeat("x", 100), nil)
+			return err
+		}) == nil)
+	}
+	stop = follow(replica)
+	caughtUp(replica)
+	assert.Assert(replica.ReplicaStatus().Resyncs == 1)
+	assert.Assert(replica.View(func(tx *Tx) error {
+		val, err := tx.Get("user:9")
+		assert.Assert(err == nil && val == strings.Repeat("x", 100))
+		n, err := tx.Len()
+		assert.Assert(err == nil && n == 12)
+		return nil
+	}) == nil)
+	stop()
+}
+
+func TestReplicationSyncChunks(t *testing.T) {
+	primary, err := OpenWithOptions(":memory:", Options{})
+	assert.Assert(err == nil)
+	defer primary.Close()
+	// the copy is larger than a single chunk.
+	val := strings.Repeat("x", 2048)
+	assert.Assert(primary.Update(func(tx *Tx) error {
+		for i := 0; i < 4096; i++ {
+			_, _, err := tx.Set(fmt.Sprintf("key:%04d", i), val, nil)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}) == nil)
+	os.RemoveAll("replica.db")
+	defer os.RemoveAll("replica.db")
+	// the copy is encrypted as it's written.
+	opts := Options{Replica: true,
+		EncryptionKey: []byte("0123456789abcdef")}
+	replica, err := OpenWithOptions("replica.db", opts)
+	assert.Assert(err == nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	c1, c2 := net.Pipe()
+	errs := make(chan error, 2)
+	go func() { errs <- primary.Replicate(ctx, c1) }()
+	go func() { errs <- replica.Follow(ctx, c2) }()
+	start := time.Now()
+	for replica.ReplicaStatus().Seq != 1 {
+		if time.Since(start) > time.Second*5 {
+			t.Fatal("replica did not catch up")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	assert.Assert(<-errs == context.Canceled)
+	assert.Assert(<-errs == context.Canceled)
+	assert.Assert(replica.Close() == nil)
+	// the copy was written to the file of the replica.
+	replica, err = OpenWithOptions("replica.db", opts)
+	assert.Assert(err == nil)
+	defer replica.Close()
+	assert.Assert(replica.View(func(tx *Tx) error {
+		n, err := tx.Len()
+		assert.Assert(err == nil && n == 4096)
+		v, err := tx.Get("key:4095")
+		assert.Assert(err == nil && v == val)
+		return nil
+	}) == nil)
+}
+
+func TestReplicationSyncFailed(t *testing.T) {
+	primary, err := OpenWithOptions(":memory:", Options{})
+	assert.Assert(err == nil)
+	defer primary.Close()
+	for i := 0; i < 50; i++ {
+		assert.Assert(primary.Update(func(tx *Tx) error {
+			_, _, err := tx.Set(fmt.Sprintf("key:%d", i), "val", nil)
+			return err
+		}) == nil)
+	}
+	var snap bytes.Buffer
+	assert.Assert(primary.Save(&snap) == nil)
+	os.RemoveAll("replica.db")
+	defer os.RemoveAll("replica.db")
+	replica, err := Open("replica.db")
+	assert.Assert(err == nil)
+	for i := 0; i < 5; i++ {
+		assert.Assert(replica.Update(func(tx *Tx) error {
+			_, _, err := tx.Set(fmt.Sprintf("old:%d", i), "val", nil)
+			return err
+		}) == nil)
+	}
+	assert.Assert(replica.Close() == nil)
+	replica, err = OpenWithOptions("replica.db", Options{Replica: true})
+	assert.Assert(err == nil)
+	defer replica.Close()
+	size, err := replica.file.Size()
+	assert.Assert(err == nil)
+	// the copy ends after its first chunk.
+	c1, c2 := net.Pipe()
+	errs := make(chan error, 1)
+	go func() { errs <- replica.Follow(context.Background(), c2) }()
+	cr := &commandReader{r: bufio.NewReader(c1), data: make([]byte, 64)}
+	_, err = cr.readCommand()
+	assert.Assert(err == nil && cr.parts[0] == "replicate" && cr.parts[1] == "5")
+	buf := appendArray(nil, 2)
+	buf = appendBulkString(buf, "sync")
+	buf = appendBulkString(buf, "50")
+	buf = appendArray(buf, 2)
+	buf = appendBulkString(buf, "chunk")
+	buf = appendBulkString(buf, snap.String()[:snap.Len()/2])
+	_, err = c1.Write(buf)
+	assert.Assert(err == nil)
+	assert.Assert(c1.Close() == nil)
+	assert.Assert(<-errs != nil)
+	// the replica is unchanged, and asks for the same commits again.
+	assert.Assert(replica.ReplicaStatus().Seq == 5)
+	assert.Assert(replica.View(func(tx *Tx) error {
+		n, err := tx.Len()
+		assert.Assert(err == nil && n == 5)
+		val, err := tx.Get("old:4")
+		assert.Assert(err == nil && val == "val")
+		return nil
+	}) == nil)
+	c1, c2 = net.Pipe()
+	go func() { errs <- replica.Follow(context.Background(), c2) }()
+	cr.r = bufio.NewReader(c1)
+	_, err = cr.readCommand()
+	assert.Assert(err == nil && cr.parts[1] == "5")
+	assert.Assert(c1.Close() == nil)
+	assert.Assert(<-errs != nil)
+	// the file was not replaced.
+	n, err := replica.file.Size()
+	assert.Assert(err == nil && n == size)
+}
+
+func TestReadOnly(t *testing.T) {
+	os.RemoveAll("data.db")
+	defer os.RemoveAll("data.db")
+	_, err := OpenReadOnly("data.db")
+	assert.Assert(os.IsNotExist(err))
+	db, err := Open("data.db")
+	assert.Assert(err == nil)
+	defer db.Close()
+	assert.Assert(db.Update(func(tx *Tx) error {
+		if err := tx.CreateIndexNamed("val", "*", nil, "string"); err != nil {
+			return err
+		}
+		_, _, err := tx.Set("key:1", "b", nil)
+		return err
+	}) == nil)
+	ro, err := OpenReadOnly("data.db")
+	assert.Assert(err == nil)
+	defer ro.Close()
+	_, err = ro.Begin(true)
+	assert.Assert(err == ErrTxNotWritable)
+	assert.Assert(ro.Update(func(tx *Tx) error { return nil }) ==
+		ErrTxNotWritable)
+	assert.Assert(ro.Shrink() == ErrInvalidOperation)
+	assert.Assert(db.Refresh() == ErrInvalidOperation)
+	count := func() (n int) {
+		assert.Assert(ro.View(func(tx *Tx) error {
+			return tx.Ascend("val", func(key, val string) bool {
+				n++
+				return true
+			})
+		}) == nil)
+		return n
+	}
+	assert.Assert(count() == 1)
+	// the records that the writer appends are loaded by Refresh.
+	assert.Assert(db.Update(func(tx *Tx) error {
+		_, _, err := tx.Set("key:2", "a", nil)
+		return err
+	}) == nil)
+	assert.Assert(count() == 1)
+	assert.Assert(ro.Refresh() == nil)
+	assert.Assert(count() == 2)
+	// the file is loaded again after the writer has replaced it.
+	assert.Assert(db.Update(func(tx *Tx) error {
+		_, err := tx.Delete("key:1")
+		return err
+	}) == nil)
+	assert.Assert(db.Shrink() == nil)
+	assert.Assert(ro.Refresh() == nil)
+	assert.Assert(count() == 1)
+	assert.Assert(db.Close() == nil)
+	// a transaction that is partly written is not truncated, and is loaded
+	// once it's complete.
+	fi, err := os.Stat("data.db")
+	assert.Assert(err == nil)
+	rec := []byte(beginRecord + "*3\r\n$3\r\nset\r\n$5\r\nkey:3\r\n$1\r\nc\r\n" +
+		"*1\r\n$6\r\ncommit\r\n")
+	f, err := os.OpenFile("data.db", os.O_WRONLY|os.O_APPEND, 0666)
+	assert.Assert(err == nil)
+	defer f.Close()
+	_, err = f.Write(rec[:30])
+	assert.Assert(err == nil)
+	assert.Assert(ro.Refresh() == nil)
+	assert.Assert(count() == 1)
+	fi2, err := os.Stat("data.db")
+	assert.Assert(err == nil && fi2.Size() == fi.Size()+30)
+	assert.Assert(len(ro.RecoveryReport().Lost) == 0)
+	_, err = f.Write(rec[30:])
+	assert.Assert(err == nil)
+	assert.Assert(ro.Refresh() == nil)
+	assert.Assert(count() == 2)
+	// the file is tailed at an interval.
+	tail, err := OpenWithOptions("data.db", Options{ReadOnly: true,
+		TailInterval: time.Millisecond * 10})
+	assert.Assert(err == nil)
+	defer tail.Close()
+	_, err = f.Write([]byte(beginRecord +
+		"*3\r\n$3\r\nset\r\n$5\r\nkey:4\r\n$1\r\nd\r\n*1\r\n$6\r\ncommit\r\n"))
+	assert.Assert(err == nil)
+	start := time.Now()
+	for {
+		var err error
+		assert.Assert(tail.View(func(tx *Tx) error {
+			_, err = tx.Get("key:4")
+			return nil
+		}) == nil)
+		if err == nil {
+			break
+		}
+		if time.Since(start) > time.Second*5 {
+			t.Fatal("the appended record was not loaded")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFileLock(t *testing.T) {
+	if !fileLocking {
+		t.Skip("file locking is not supported")
+	}
+	db := testOpen(t)
+	defer testClose(db)
+	_, err := Open("data.db")
+	assert.Assert(err == ErrLocked)
+	// the file is still locked after it was replaced by a shrink.
+	assert.Assert(db.Update(func(tx *Tx) error {
+		for i := 0; i < 100; i++ {
+			tx.Set("key", strconv.Itoa(i), nil)
+		}
+		return nil
+	}) == nil)
+	for i := 0; i < 2; i++ {
+		assert.Assert(db.Shrink() == nil)
+		_, err = Open("data.db")
+		assert.Assert(err == ErrLocked)
+	}
+	// a read-only database does not need the lock.
+	ro, err := OpenReadOnly("data.db")
+	assert.Assert(err == nil)
+	assert.Assert(ro.Close() == nil)
+	db = testReOpen(t, db)
+	defer testClose(db)
+	assert.Assert(db.View(func(tx *Tx) error {
+		val, err := tx.Get("key")
+		assert.Assert(err == nil && val == "99")
+		return nil
+	}) == nil)
+}
+
+func TestMemoryStorage(t *testing.T) {
+	store := NewMemoryStorage()
+	db, err := OpenWithOptions("", Options{Storage: store})
+	assert.Assert(err == nil)
+	assert.Assert(db.Update(func(tx *Tx) error {
+		if err := tx.CreateIndexNamed("val", "*", nil, "string"); err != nil {
+			return err
+		}
+		for i := 0; i < 100; i++ {
+			tx.Set(fmt.Sprintf("key:%d", i), strconv.Itoa(i%10), nil)
+		}
+		return nil
+	}) == nil)
+	assert.Assert(db.Update(func(tx *Tx) error {
+		for i := 10; i < 100; i++ {
+			tx.Delete(fmt.Sprintf("key:%d", i))
+		}
+		return nil
+	}) == nil)
+	size, err := store.Size()
+	assert.Assert(err == nil && size > 0)
+	assert.Assert(db.Shrink() == nil)
+	size2, err := store.Size()
+	assert.Assert(err == nil && size2 < size)
+	assert.Assert(db.Update(func(tx *Tx) error {
+		_, _, err := tx.Set("key:10", "a", nil)
+		return err
+	}) == nil)
+	assert.Assert(db.Close() == nil)
+	// a transaction that was only partly written is truncated.
+	size, err = store.Size()
+	assert.Assert(err == nil)
+	_, err = store.Append([]byte(beginRecord + "*3\r\n$3\r\nset\r\n"))
+	assert.Assert(err == nil)
+	db, err = OpenWithOptions("", Options{Storage: store})
+	assert.Assert(err == nil)
+	defer db.Close()
+	report := db.RecoveryReport()
+	assert.Assert(len(report.Lost) == 1 && report.Lost[0].Truncated)
+	size2, err = store.Size()
+	assert.Assert(err == nil && size2 == size)
+	var keys []string
+	assert.Assert(db.View(func(tx *Tx) error {
+		return tx.Ascend("val", func(key, val string) bool {
+			keys = append(keys, key)
+			return true
+		})
+	}) == nil)
+	assert.Assert(len(keys) == 11 && keys[0] == "key:0" && keys[10] == "key:10")
+}
+
+func TestEncryption(t *testing.T) {
+	key1 := []byte("0123456789abcdef0123456789abcdef")
+	key2 := []byte("fedcba9876543210fedcba9876543210")
+	store := NewMemoryStorage()
+	data := func() string {
+		size, err := store.Size()
+		assert.Assert(err == nil)
+		buf := make([]byte, size)
+		_, err = store.ReadAt(buf, 0)
+		assert.Assert(err == nil || err == io.EOF)
+		return string(buf)
+	}
+	open := func(opts Options) (*DB, error) {
+		opts.Storage = store
+		return OpenWithOptions("", opts)
+	}
+	check := func(db *DB, n int) {
+		assert.Assert(db.View(func(tx *Tx) error {
+			count, err := tx.Len()
+			assert.Assert(err == nil && count == n)
+			val, err := tx.Get("token:1")
+			assert.Assert(err == nil && val == "secret:1")
+			return nil
+		}) == nil)
+	}
+	set := func(db *DB, start, end int) {
+		assert.Assert(db.Update(func(tx *Tx) error {
+			for i := start; i < end; i++ {
+				_, _, err := tx.Set(fmt.Sprintf("token:%d", i),
+					fmt.Sprintf("secret:%d", i), nil)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}) == nil)
+	}
+
+	// a plain file is encrypted when it's opened with a key.
+	db, err := open(Options{})
+	assert.Assert(err == nil)
+	set(db, 0, 10)
+	assert.Assert(db.Close() == nil)
+	assert.Assert(strings.Contains(data(), "secret:1"))
+	db, err = open(Options{EncryptionKey: key1})
+	assert.Assert(err == nil)
+	check(db, 10)
+	assert.Assert(strings.HasPrefix(data(), encRecord))
+	assert.Assert(!strings.Contains(data(), "secret:"))
+
+	// commits and shrinks are encrypted.
+	db.SetConfig(Config{SnapshotFormat: BinarySnapshot})
+	set(db, 10, 20)
+	assert.Assert(db.Shrink() == nil)
+	set(db, 20, 30)
+	assert.Assert(db.Close() == nil)
+	assert.Assert(!strings.Contains(data(), "secret:"))
+	assert.Assert(strings.Contains(data(), keyID(key1)))
+
+	// the file cannot be opened without the key.
+	_, err = open(Options{})
+	assert.Assert(err == ErrEncryptionKey)
+	_, err = open(Options{EncryptionKey: key2})
+	assert.Assert(err == ErrEncryptionKey)
+	_, err = open(Options{EncryptionKey: []byte("short")})
+	assert.Assert(err != nil)
+
+	// a commit that was only partly written is truncated.
+	size, err := store.Size()
+	assert.Assert(err == nil)
+	_, err = store.Append([]byte(encRecord + "$8\r\n" + keyID(key1) + "\r\n$16\r\n"))
+	assert.Assert(err == nil)
+	db, err = open(Options{EncryptionKey: key1})
+	assert.Assert(err == nil)
+	check(db, 30)
+	report := db.RecoveryReport()
+	assert.Assert(len(report.Lost) == 1 && report.Lost[0].Offset == size &&
+		report.Lost[0].Truncated)
+	assert.Assert(db.Close() == nil)
+
+	// a tampered record does not load.
+	raw := []byte(data())
+	raw[len(raw)-10] ^= 1
+	store = NewMemoryStorage()
+	_, err = store.Append(raw)
+	assert.Assert(err == nil)
+	_, err = open(Options{EncryptionKey: key1})
+	assert.Assert(err == ErrChecksum)
+	db, err = open(Options{EncryptionKey: key1, Recovery: RecoverTruncate})
+	assert.Assert(err == nil)
+	check(db, 20)
+	set(db, 20, 30)
+	assert.Assert(db.Close() == nil)
+
+	// the key is rotated by rewriting the file.
+	db, err = open(Options{EncryptionKey: key2, DecryptionKeys: [][]byte{key1}})
+	assert.Assert(err == nil)
+	check(db, 30)
+	assert.Assert(db.Close() == nil)
+	assert.Assert(!strings.Contains(data(), keyID(key1)))
+	db, err = open(Options{EncryptionKey: key2})
+	assert.Assert(err == nil)
+	check(db, 30)
+	assert.Assert(db.Close() == nil)
+
+	// the file is decrypted when there is no encryption key.
+	db, err = open(Options{DecryptionKeys: [][]byte{key2}})
+	assert.Assert(err == nil)
+	check(db, 30)
+	assert.Assert(db.Close() == nil)
+	assert.Assert(strings.Contains(data(), "secret:1"))
+	db, err = open(Options{})
+	assert.Assert(err == nil)
+	check(db, 30)
+	assert.Assert(db.Close() == nil)
+
+	// the data written by Save is encrypted.
+	db, err = OpenWithOptions(":memory:", Options{EncryptionKey: key1})
+	assert.Assert(err == nil)
+	defer db.Close()
+	set(db, 0, 10)
+	var buf bytes.Buffer
+	assert.Assert(db.Save(&buf) == nil)
+	assert.Assert(!strings.Contains(buf.String(), "secret:"))
+	db2, err := Open(":memory:")
+	assert.Assert(err == nil)
+	defer db2.Close()
+	assert.Assert(db2.Load(bytes.NewReader(buf.Bytes())) == ErrEncryptionKey)
+	db3, err := OpenWithOptions(":memory:", Options{EncryptionKey: key1})
+	assert.Assert(err == nil)
+	defer db3.Close()
+	assert.Assert(db3.Load(bytes.NewReader(buf.Bytes())) == nil)
+	check(db3, 10)
+	// the data must not end early.
+	end := strings.LastIndex(buf.String(), encRecord)
+	assert.Assert(db3.Load(bytes.NewReader(buf.Bytes()[:end])) == ErrInvalid)
+
+	// the commits of a file are split into their records.
+	commits := func() []string {
+		store = NewMemoryStorage()
+		db, err := open(Options{EncryptionKey: key1})
+		assert.Assert(err == nil)
+		var recs []string
+		for i := 0; i < 4; i++ {
+			last := len(data())
+			set(db, i*10, i*10+10)
+			recs = append(recs, data()[last:])
+		}
+		assert.Assert(db.Close() == nil)
+		return recs
+	}
+	recs, other := commits(), commits()
+	load := func(opts Options, recs ...string) (*DB, error) {
+		store = NewMemoryStorage()
+		_, err := store.Append([]byte(strings.Join(recs, "")))
+		assert.Assert(err == nil)
+		opts.EncryptionKey = key1
+		return open(opts)
+	}
+	db, err = load(Options{}, recs...)
+	assert.Assert(err == nil)
+	check(db, 40)
+	assert.Assert(db.Close() == nil)
+	// records that are dropped, reordered, replayed, or taken from another
+	// file do not load.
+	for _, bad := range [][]string{
+		{recs[1], recs[2], recs[3]},
+		{recs[0], recs[2], recs[3]},
+		{recs[0], recs[2], recs[1], recs[3]},
+		{recs[0], recs[1], recs[1], recs[2]},
+		{recs[0], other[1], recs[2], recs[3]},
+	} {
+		_, err = load(Options{}, bad...)
+		assert.Assert(err == ErrChecksum)
+	}
+	// the records after the ones that are missing are skipped to.
+	db, err = load(Options{Recovery: RecoverSkip}, recs[0], recs[2], recs[3])
+	assert.Assert(err == nil)
+	check(db, 20)
+	assert.Assert(len(db.RecoveryReport().Lost) == 1)
+	assert.Assert(db.Close() == nil)
+
+	// an empty database is written and loaded too.
+	empty := func(db *DB) {
+		assert.Assert(db.View(func(tx *Tx) error {
+			n, err := tx.Len()
+			assert.Assert(err == nil && n == 0)
+			return nil
+		}) == nil)
+	}
+	store = NewMemoryStorage()
+	db, err = open(Options{EncryptionKey: key1})
+	assert.Assert(err == nil)
+	assert.Assert(db.Shrink() == nil)
+	assert.Assert(db.Close() == nil)
+	db, err = open(Options{EncryptionKey: key1})
+	assert.Assert(err == nil)
+	empty(db)
+	buf.Reset()
+	assert.Assert(db.Save(&buf) == nil)
+	var backup bytes.Buffer
+	assert.Assert(db.Backup(context.Background(), &backup) == nil)
+	assert.Assert(db.Close() == nil)
+	db4, err := OpenWithOptions(":memory:", Options{EncryptionKey: key1})
+	assert.Assert(err == nil)
+	defer db4.Close()
+	assert.Assert(db4.Load(&buf) == nil)
+	empty(db4)
+	store = NewMemoryStorage()
+	_, err = store.Append(backup.Bytes())
+	assert.Assert(err == nil)
+	db, err = open(Options{EncryptionKey: key1})
+	assert.Assert(err == nil)
+	empty(db)
+	assert.Assert(db.Close() == nil)
+}
+
+func TestCompression(t *testing.T) {
+	big := func(i int) string {
+		return fmt.Sprintf(`{"name":"user:%d","bio":"%s"}`, i,
+			strings.Repeat("lorem ipsum ", 100))
+	}
+	for _, memory := range []bool{false, true} {
+		for _, format := range []SnapshotFormat{RESPSnapshot, BinarySnapshot} {
+			store := NewMemoryStorage()
+			opts := Options{
+				Storage:              store,
+				Compression:          NewDeflateCodec(),
+				CompressionThreshold: 100,
+				CompressInMemory:     memory,
+			}
+			db, err := OpenWithOptions("", opts)
+			assert.Assert(err == nil)
+			db.SetConfig(Config{SnapshotFormat: format})
+			sub, err := db.Subscribe("*")
+			assert.Assert(err == nil)
+			assert.Assert(db.Update(func(tx *Tx) error {
+				err := tx.CreateIndexNamed("name", "*", nil, "json:name")
+				if err != nil {
+					return err
+				}
+				for i := 9; i >= 0; i-- {
+					if _, _, err := tx.Set(fmt.Sprintf("big:%d", i), big(i),
+						nil); err != nil {
+						return err
+					}
+				}
+				_, _, err = tx.Set("small", `{"name":"user:z"}`, nil)
+				return err
+			}) == nil)
+			ev := <-sub.C
+			assert.Assert(ev.Value == big(9))
+			sub.Close()
+			check := func(db *DB) {
+				assert.Assert(db.View(func(tx *Tx) error {
+					val, err := tx.Get("big:3")
+					assert.Assert(err == nil && val == big(3))
+					var keys []string
+					err = tx.Ascend("name", func(key, val string) bool {
+						if key != "small" {
+							assert.Assert(val == big(len(keys)))
+						}
+						keys = append(keys, key)
+						return true
+					})
+					assert.Assert(err == nil && len(keys) == 11)
+					assert.Assert(keys[0] == "big:0" && keys[10] == "small")
+					return nil
+				}) == nil)
+				item := db.keys.Get(&dbItem{key: "big:1"}).(*dbItem)
+				assert.Assert(item.compressed == memory)
+			}
+			check(db)
+			assert.Assert(db.Shrink() == nil)
+			size, err := store.Size()
+			assert.Assert(err == nil && size < 4000)
+			buf := make([]byte, size)
+			_, err = store.ReadAt(buf, 0)
+			assert.Assert(err == nil || err == io.EOF)
+			assert.Assert(!strings.Contains(string(buf), "lorem ipsum lorem"))
+			assert.Assert(strings.Contains(string(buf), "user:z"))
+			assert.Assert(db.Close() == nil)
+
+			db, err = OpenWithOptions("", opts)
+			assert.Assert(err == nil)
+			check(db)
+			assert.Assert(db.Close() == nil)
+
+			// the codec is needed for loading the compressed values.
+			_, err = OpenWithOptions("", Options{Storage: store})
+			assert.Assert(err == ErrUnknownCodec)
+		}
+
+		// a corrupt compressed value does not load.
+		codec := NewDeflateCodec()
+		data := string(codec.Encode(nil, []byte(big(1))))
+		set := func(key, val string) []byte {
+			buf := appendArray(nil, 5)
+			buf = appendBulkString(buf, "set")
+			buf = appendBulkString(buf, key)
+			buf = appendBulkString(buf, val)
+			buf = appendBulkString(buf, "codec")
+			return appendBulkString(buf, codec.Name())
+		}
+		store := NewMemoryStorage()
+		_, err := store.Append(append(set("good", data),
+			set("bad", data[:len(data)/2])...))
+		assert.Assert(err == nil)
+		opts := Options{Storage: store, Compression: codec,
+			CompressInMemory: memory}
+		_, err = OpenWithOptions("", opts)
+		assert.Assert(err == ErrInvalid)
+		opts.Recovery = RecoverTruncate
+		db, err := OpenWithOptions("", opts)
+		assert.Assert(err == nil)
+		assert.Assert(db.View(func(tx *Tx) error {
+			val, err := tx.Get("good")
+			assert.Assert(err == nil && val == big(1))
+			_, err = tx.Get("bad")
+			assert.Assert(err == ErrNotFound)
+			return nil
+		}) == nil)
+		assert.Assert(db.Close() == nil)
+	}
+}
+
+func TestSegments(t *testing.T) {
+	const dir = "data.segs"
+	_ = os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	opts := Options{SegmentSize: 1024}
+	files := func() []string {
+		ents, err := os.ReadDir(dir)
+		assert.Assert(err == nil)
+		var names []string
+		for _, ent := range ents {
+			if ent.Name() != "LOCK" {
+				names = append(names, ent.Name())
+			}
+		}
+		return names
+	}
+	set := func(db *DB, start, end int) {
+		for i := start; i < end; i++ {
+			assert.Assert(db.Update(func(tx *Tx) error {
+				_, _, err := tx.Set(fmt.Sprintf("key:%04d", i%100),
+					strconv.Itoa(i), nil)
+				return err
+			}) == nil)
+		}
+	}
+	check := func(db *DB, last int) {
+		assert.Assert(db.View(func(tx *Tx) error {
+			n, err := tx.Len()
+			assert.Assert(err == nil && n == 100)
+			val, err := tx.Get(fmt.Sprintf("key:%04d", last%100))
+			assert.Assert(err == nil && val == strconv.Itoa(last))
+			return nil
+		}) == nil)
+	}
+	db, err := OpenWithOptions(dir, opts)
+	assert.Assert(err == nil)
+	set(db, 0, 300)
+	check(db, 299)
+	names := files()
+	assert.Assert(len(names) > 10)
+	assert.Assert(names[0] == "segment-00000001.aof")
+	// only the active segment is larger than the segment size.
+	for _, name := range names[:len(names)-1] {
+		fi, err := os.Stat(filepath.Join(dir, name))
+		assert.Assert(err == nil && fi.Size() <= 1024)
+	}
+	_, err = OpenWithOptions(dir, opts)
+	assert.Assert(err == ErrLocked)
+
+	// a shrink writes a base and deletes the previous segments.
+	assert.Assert(db.Shrink() == nil)
+	active := fmt.Sprintf("segment-%08d.aof", len(names)+1)
+	base := fmt.Sprintf("base-%08d.aof", len(names)+1)
+	names = files()
+	assert.Assert(len(names) == 2 && names[0] == base && names[1] == active)
+	set(db, 300, 400)
+	check(db, 399)
+	assert.Assert(db.Close() == nil)
+	db, err = OpenWithOptions(dir, opts)
+	assert.Assert(err == nil)
+	check(db, 399)
+
+	// a read-only database finds the new segments, and the new base.
+	ro, err := OpenWithOptions(dir, Options{SegmentSize: 1024, ReadOnly: true})
+	assert.Assert(err == nil)
+	defer ro.Close()
+	check(ro, 399)
+	set(db, 400, 500)
+	assert.Assert(ro.Refresh() == nil)
+	check(ro, 499)
+	assert.Assert(db.Shrink() == nil)
+	set(db, 500, 510)
+	assert.Assert(ro.Refresh() == nil)
+	check(ro, 509)
+	assert.Assert(db.Close() == nil)
+
+	// the files that are left over by a shrink that did not complete, or
+	// that did not delete the previous files, are deleted.
+	names = files()
+	data, err := os.ReadFile(filepath.Join(dir, names[0]))
+	assert.Assert(err == nil)
+	assert.Assert(os.WriteFile(filepath.Join(dir, "base-00000001.aof"),
+		data, 0666) == nil)
+	assert.Assert(os.WriteFile(filepath.Join(dir, "segment-00000001.aof"),
+		data, 0666) == nil)
+	assert.Assert(os.WriteFile(filepath.Join(dir, "base-00009999.aof.tmp"),
+		data, 0666) == nil)
+	// a commit that was only partly written is truncated.
+	f, err := os.OpenFile(filepath.Join(dir, names[len(names)-1]),
+		os.O_WRONLY|os.O_APPEND, 0666)
+	assert.Assert(err == nil)
+	_, err = f.WriteString(beginRecord + "*3\r\n$3\r\nset\r\n")
+	assert.Assert(err == nil && f.Close() == nil)
+	db, err = OpenWithOptions(dir, opts)
+	assert.Assert(err == nil)
+	defer db.Close()
+	check(db, 509)
+	report := db.RecoveryReport()
+	assert.Assert(len(report.Lost) == 1 && report.Lost[0].Truncated)
+	assert.Assert(strings.Join(files(), ",") == strings.Join(names, ","))
+}
+
+func TestBackup(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	defer os.RemoveAll("backup.db")
+	var progress []BackupProgress
+	db.SetConfig(Config{
+		SyncPolicy: EverySecond,
+		OnBackupProgress: func(p BackupProgress) {
+			progress = append(progress, p)
+		},
+	})
+	assert.Assert(db.Update(func(tx *Tx) error {
+		if err := tx.CreateIndexNamed("val", "*", nil, "int"); err != nil {
+			return err
+		}
+		for i := 0; i < 1000; i++ {
+			if _, _, err := tx.Set(fmt.Sprintf("key:%d", i), "0", nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	}) == nil)
+	// every transaction changes all of the items, while the backups are
+	// written.
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for n := 1; ; n++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			assert.Assert(db.Update(func(tx *Tx) error {
+				for i := 0; i < 1000; i++ {
+					_, _, err := tx.Set(fmt.Sprintf("key:%d", i),
+						strconv.Itoa(n), nil)
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			}) == nil)
+			if n%10 == 0 {
+				assert.Assert(db.Shrink() == nil)
+			}
+		}
+	}()
+	check := func(db *DB) {
+		assert.Assert(db.View(func(tx *Tx) error {
+			n, err := tx.Len()
+			assert.Assert(err == nil && n == 1000)
+			first, err := tx.Get("key:0")
+			assert.Assert(err == nil)
+			return tx.Ascend("val", func(key, val string) bool {
+				assert.Assert(val == first)
+				return true
+			})
+		}) == nil)
+	}
+	for i := 0; i < 5; i++ {
+		var buf bytes.Buffer
+		assert.Assert(db.Backup(context.Background(), &buf) == nil)
+		assert.Assert(len(progress) > 0)
+		last := progress[len(progress)-1]
+		assert.Assert(last.Items == 1000 && last.Total == 1000 &&
+			last.Bytes == int64(buf.Len()))
+		mem, err := Open(":memory:")
+		assert.Assert(err == nil)
+		assert.Assert(mem.Load(&buf) == nil)
+		check(mem)
+		assert.Assert(mem.Close() == nil)
+
+		assert.Assert(db.BackupTo("backup.db") == nil)
+		bak, err := Open("backup.db")
+		assert.Assert(err == nil)
+		check(bak)
+		assert.Assert(bak.Close() == nil)
+		time.Sleep(time.Millisecond * 10)
+	}
+	close(done)
+	wg.Wait()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Assert(db.Backup(ctx, io.Discard) == context.Canceled)
+}
@@ -0,0 +1,169 @@
+package buntdb
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"sync"
+)
+
+// Codec compresses values. See Options.Compression.
+type Codec interface {
+	// Name identifies the codec in the database file. A file that has
+	// values that were compressed with a codec can only be opened with the
+	// same codec.
+	Name() string
+	// Encode appends the compressed data of src to dst.
+	Encode(dst, src []byte) []byte
+	// Decode appends the decompressed data of src to dst.
+	Decode(dst, src []byte) ([]byte, error)
+}
+
+// NewDeflateCodec returns a Codec that compresses with DEFLATE at the
+// fastest level. It's safe for concurrent use.
+func NewDeflateCodec() Codec {
+	return deflateCodec{}
+}
+
+// deflateCodec is a Codec that uses the compress/flate package. The writers
+// and readers are reused, because they're expensive to create.
+type deflateCodec struct{}
+
+var (
+	deflateWriters sync.Pool
+	deflateReaders sync.Pool
+)
+
+func (deflateCodec) Name() string {
+	return "deflate"
+}
+
+func (deflateCodec) Encode(dst, src []byte) []byte {
+	buf := bytes.NewBuffer(dst)
+	fw, _ := deflateWriters.Get().(*flate.Writer)
+	if fw == nil {
+		fw, _ = flate.NewWriter(buf, flate.BestSpeed)
+	} else {
+		fw.Reset(buf)
+	}
+	// writing to a bytes.Buffer does not fail.
+	_, _ = fw.Write(src)
+	_ = fw.Close()
+	deflateWriters.Put(fw)
+	return buf.Bytes()
+}
+
+func (deflateCodec) Decode(dst, src []byte) ([]byte, error) {
+	rd := bytes.NewReader(src)
+	fr, _ := deflateReaders.Get().(io.ReadCloser)
+	if fr == nil {
+		fr = flate.NewReader(rd)
+	} else if err := fr.(flate.Resetter).Reset(rd, nil); err != nil {
+		return nil, err
+	}
+	defer deflateReaders.Put(fr)
+	buf := bytes.NewBuffer(dst)
+	if _, err := buf.ReadFrom(fr); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// compression compresses the values of a database.
+type compression struct {
+	codec     Codec
+	threshold int  // the size of the smallest value that is compressed
+	memory    bool // values are kept compressed in memory
+}
+
+// newCompression returns the compression for the options, or nil when
+// values are not compressed.
+func newCompression(opts Options) *compression {
+	if opts.Compression == nil {
+		return nil
+	}
+	z := &compression{
+		codec:     opts.Compression,
+		threshold: opts.CompressionThreshold,
+		memory:    opts.CompressInMemory,
+	}
+	if z.threshold <= 0 {
+		z.threshold = 1024
+	}
+	return z
+}
+
+// compress returns the compressed value, or false when the value is too
+// small to be compressed, or does not get any smaller.
+func (z *compression) compress(val string) (string, bool) {
+	if z == nil || len(val) < z.threshold {
+		return "", false
+	}
+	data := z.codec.Encode(nil, []byte(val))
+	if len(data) >= len(val) {
+		return "", false
+	}
+	return string(data), true
+}
+
+// encode returns the value of an item as it's written to the database file,
+// and the name of the codec when the value is compressed.
+func (z *compression) encode(dbi *dbItem) (val, codec string) {
+	if dbi.compressed {
+		return dbi.val, z.codec.Name()
+	}
+	if data, ok := z.compress(dbi.val); ok {
+		return data, z.codec.Name()
+	}
+	return dbi.val, ""
+}
+
+// pack compresses the value of an item that is kept in memory, when values
+// are kept compressed in memory.
+func (z *compression) pack(dbi *dbItem) {
+	if z == nil || !z.memory || dbi.compressed {
+		return
+	}
+	if data, ok := z.compress(dbi.val); ok {
+		dbi.val, dbi.compressed = data, true
+	}
+}
+
+// loadValue prepares the value of an item that was loaded from the database
+// file. The codec is the name of the codec of a compressed value. A value
+// that is kept compressed in memory is decoded too, so that a corrupt value
+// fails to load instead of failing every read of it.
+func (db *DB) loadValue(dbi *dbItem, codec string) error {
+	z := db.zip
+	if codec == "" {
+		z.pack(dbi)
+		return nil
+	}
+	if z == nil || codec != z.codec.Name() {
+		return ErrUnknownCodec
+	}
+	val, err := z.codec.Decode(nil, []byte(dbi.val))
+	if err != nil {
+		return ErrInvalid
+	}
+	if z.memory {
+		dbi.compressed = true
+		return nil
+	}
+	dbi.val = string(val)
+	return nil
+}
+
+// value returns the value of an item, which is decompressed when it's kept
+// compressed in memory.
+func (db *DB) value(dbi *dbItem) string {
+	if !dbi.compressed {
+		return dbi.val
+	}
+	val, err := db.zip.codec.Decode(nil, []byte(dbi.val))
+	if err != nil {
+		// the value was compressed by the same codec.
+		panicErr(err)
+	}
+	return string(val)
+}
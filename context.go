@@ -0,0 +1,63 @@
+package buntdb
+
+import "context"
+
+// BeginContext opens a new transaction just like Begin, but gives up waiting
+// for another read/write transaction when the context is done, in which case
+// the error of the context is returned.
+// The context is also used by the transaction, where iterating, such as with
+// Ascend or Intersects, stops and returns the error of the context when it's
+// done.
+func (db *DB) BeginContext(ctx context.Context, writable bool) (*Tx, error) {
+	return db.begin(ctx, writable, false)
+}
+
+// ViewContext executes a function within a managed read-only transaction
+// just like View. See BeginContext for how the context is used.
+func (db *DB) ViewContext(ctx context.Context, fn func(tx *Tx) error) error {
+	return db.managed(ctx, false, false, fn)
+}
+
+// UpdateContext executes a function within a managed read/write transaction
+// just like Update. See BeginContext for how the context is used.
+func (db *DB) UpdateContext(ctx context.Context, fn func(tx *Tx) error) error {
+	return db.managed(ctx, true, false, fn)
+}
+
+// lockContext locks the database for writing, or returns the error of the
+// context when it's done before the lock is acquired. The ctx may be nil.
+func (db *DB) lockContext(ctx context.Context) error {
+	if ctx == nil {
+		db.Lock()
+		return nil
+	} else if err := ctx.Err(); err != nil {
+		return err
+	} else if db.TryLock() {
+		return nil
+	}
+	locked := make(chan struct{})
+	go func() {
+		db.Lock()
+		select {
+		case locked <- struct{}{}:
+		case <-ctx.Done():
+			// nobody is waiting for the lock anymore.
+			db.Unlock()
+		}
+	}()
+	select {
+	case <-locked:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// done returns the done channel of the context of the transaction, which is
+// nil when there is no context.
+func (tx *Tx) done() <-chan struct{} {
+	if tx.ctx == nil {
+		return nil
+	}
+	return tx.ctx.Done()
+}
@@ -0,0 +1,341 @@
+package buntdb
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"strconv"
+)
+
+// An encrypted database file is a series of ENC records, each of which holds
+// the encrypted bytes of one or more records of a plain file:
+//
+//	*6\r\n$3\r\nenc\r\n$8\r\n<key id>\r\n$16\r\n<file id>\r\n
+//	$<len>\r\n<seq>\r\n$<len>\r\n<part>\r\n$<len>\r\n<nonce><ciphertext>\r\n
+//
+// Every commit is a single ENC record, and the data written by Shrink and
+// Save is split into ENC records at the points where it's flushed. The
+// decrypted records are read just like the records of a plain file. The key
+// id is the start of the SHA-256 hash of the key, which allows for loading
+// a file that has records that were encrypted with a previous key.
+//
+// The file id is random for every file, and is kept by Shrink. The seq of a
+// commit is the sequence of the commit, with a part of 0. The data written
+// by Shrink and Save has the sequence that it was written at, and its parts
+// count from 1, followed by an empty record with a part of 0 that ends it.
+// Data that is empty, such as of an empty database, still has a part 1.
+// The file id, the seq and the part are authenticated along with the data,
+// and the records must follow each other in that order, so records that are
+// dropped, reordered, replayed, or taken from another file are not loaded.
+const encRecord = "*6\r\n$3\r\nenc\r\n"
+
+// encryption encrypts and decrypts the records of a database file with
+// AES-GCM.
+type encryption struct {
+	id   string                 // the id of the encryption key
+	aead cipher.AEAD            // encrypts records, nil to only decrypt
+	keys map[string]cipher.AEAD // decrypts records by key id
+}
+
+// newEncryption returns the encryption for the EncryptionKey and the
+// DecryptionKeys options, or nil when there are no keys.
+func newEncryption(key []byte, old [][]byte) (*encryption, error) {
+	if key == nil && len(old) == 0 {
+		return nil, nil
+	}
+	e := &encryption{keys: make(map[string]cipher.AEAD)}
+	for i, k := range append([][]byte{key}, old...) {
+		if i == 0 && k == nil {
+			// the file is only decrypted.
+			continue
+		}
+		block, err := aes.NewCipher(k)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		id := keyID(k)
+		if i == 0 {
+			e.id, e.aead = id, aead
+		}
+		if _, ok := e.keys[id]; !ok {
+			e.keys[id] = aead
+		}
+	}
+	return e, nil
+}
+
+// keyID returns the id of a key.
+func keyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:4])
+}
+
+// encrypts returns true if new records are encrypted.
+func (e *encryption) encrypts() bool {
+	return e != nil && e.aead != nil
+}
+
+// encPos is the position of an ENC record in a file.
+type encPos struct {
+	file string // the id of the file
+	seq  uint64 // the sequence of the commit, or of the written data
+	part uint64 // the part of the written data, or 0
+	gap  bool   // records may be missing before the next record
+}
+
+// newFileID returns a random file id.
+func newFileID() string {
+	var id [8]byte
+	if _, err := io.ReadFull(rand.Reader, id[:]); err != nil {
+		panicErr(err)
+	}
+	return hex.EncodeToString(id[:])
+}
+
+// aad returns the additional data that is authenticated with a record.
+func (pos encPos) aad() []byte {
+	buf := append([]byte(pos.file), ':')
+	buf = strconv.AppendUint(buf, pos.seq, 10)
+	buf = append(buf, ':')
+	return strconv.AppendUint(buf, pos.part, 10)
+}
+
+// follows returns true if a record at pos can follow the record at last,
+// which is the zero position at the start of the data.
+func (pos encPos) follows(last encPos) bool {
+	switch {
+	case last.file != "" && pos.file != last.file:
+		// the record is from another file.
+		return false
+	case last.gap:
+		return true
+	case last.file == "":
+		// the data starts with the first commit, or with written data.
+		return pos.part == 1 || (pos.part == 0 && pos.seq == 1)
+	case pos.part > 0:
+		return pos.seq == last.seq && pos.part == last.part+1
+	case last.part > 0:
+		// the record that ends the written data.
+		return pos.seq == last.seq
+	default:
+		return pos.seq == last.seq+1
+	}
+}
+
+// seal appends an ENC record with the encrypted data at a position.
+func (e *encryption) seal(buf, data []byte, pos encPos) []byte {
+	size := e.aead.NonceSize() + len(data) + e.aead.Overhead()
+	buf = append(buf, encRecord...)
+	buf = appendBulkString(buf, e.id)
+	buf = appendBulkString(buf, pos.file)
+	buf = appendBulkString(buf, strconv.FormatUint(pos.seq, 10))
+	buf = appendBulkString(buf, strconv.FormatUint(pos.part, 10))
+	buf = append(buf, '$')
+	buf = strconv.AppendInt(buf, int64(size), 10)
+	buf = append(buf, '\r', '\n')
+	start := len(buf)
+	buf = append(buf, make([]byte, e.aead.NonceSize())...)
+	nonce := buf[start:]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		panicErr(err)
+	}
+	buf = e.aead.Seal(buf, nonce, data, pos.aad())
+	return append(buf, '\r', '\n')
+}
+
+// writer returns a writer of the data of a file at a sequence, which writes
+// every Write as the next part. Close writes the record that ends the data.
+// The data is written to w as is when new records are not encrypted.
+func (e *encryption) writer(w io.Writer, file string, seq uint64) io.WriteCloser {
+	return &encWriter{e: e, w: w, pos: encPos{file: file, seq: seq}}
+}
+
+// encWriter writes ENC records to a writer.
+type encWriter struct {
+	e   *encryption
+	w   io.Writer
+	pos encPos
+	buf []byte
+}
+
+func (ew *encWriter) Write(p []byte) (int, error) {
+	if !ew.e.encrypts() {
+		return ew.w.Write(p)
+	}
+	ew.pos.part++
+	ew.buf = ew.e.seal(ew.buf[:0], p, ew.pos)
+	if _, err := ew.w.Write(ew.buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (ew *encWriter) Close() error {
+	if !ew.e.encrypts() {
+		return nil
+	}
+	if ew.pos.part == 0 {
+		// the data always starts with part 1.
+		if _, err := ew.Write(nil); err != nil {
+			return err
+		}
+	}
+	ew.pos.part = 0
+	ew.buf = ew.e.seal(ew.buf[:0], nil, ew.pos)
+	_, err := ew.w.Write(ew.buf)
+	return err
+}
+
+// fileID returns the id of the database file, which is created for a file
+// that has no ENC records yet.
+func (db *DB) fileID() string {
+	if db.encpos.file == "" {
+		db.encpos.file = newFileID()
+	}
+	return db.encpos.file
+}
+
+// encrypt returns the ENC record of a commit that is appended to the
+// database file, or data itself when the file is not encrypted.
+func (db *DB) encrypt(data []byte, seq uint64) []byte {
+	if !db.enc.encrypts() {
+		return data
+	}
+	db.encbuf = db.enc.seal(db.encbuf[:0], data,
+		encPos{file: db.fileID(), seq: seq})
+	return db.encbuf
+}
+
+// isEncrypted returns true if the reader is positioned at an ENC record.
+func isEncrypted(r *bufio.Reader) bool {
+	rec, _ := r.Peek(len(encRecord))
+	return string(rec) == encRecord
+}
+
+// encReader reads the decrypted data of ENC records. It keeps track of where
+// the records end, for translating positions in the decrypted data to
+// positions in the file.
+type encReader struct {
+	db    *DB
+	cr    *commandReader
+	pos   encPos     // the position of the last record
+	plain []byte     // decrypted data that was not read yet
+	raw   int64      // the bytes of the file that were read
+	total int64      // the bytes of decrypted data
+	ends  [][2]int64 // the decrypted and file positions of each record end
+	err   error
+}
+
+// newEncReader returns a reader of the ENC records that follow the record
+// at pos.
+func newEncReader(db *DB, r *bufio.Reader, pos encPos) *encReader {
+	return &encReader{db: db, pos: pos, cr: &commandReader{
+		r:     r,
+		data:  make([]byte, 4096),
+		parts: make([]string, 0, 6),
+	}}
+}
+
+func (er *encReader) Read(p []byte) (int, error) {
+	for len(er.plain) == 0 {
+		if er.err != nil {
+			return 0, er.err
+		}
+		er.err = er.next()
+	}
+	n := copy(p, er.plain)
+	er.plain = er.plain[n:]
+	return n, nil
+}
+
+// next decrypts the next ENC record.
+func (er *encReader) next() error {
+	r := er.cr.r
+	for {
+		// nul control characters are ignored, like in a plain file.
+		c, err := r.ReadByte()
+		if err != nil {
+			if err == io.EOF && er.pos.part > 0 {
+				// the written data was not ended.
+				err = ErrInvalid
+			}
+			return err
+		}
+		if c != 0 {
+			if err := r.UnreadByte(); err != nil {
+				return err
+			}
+			break
+		}
+		er.raw++
+	}
+	size, err := er.cr.readCommand()
+	if err != nil {
+		if err == io.EOF {
+			// the record was not completely written.
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	parts := er.cr.parts
+	if len(parts) != 6 || parts[0] != "enc" {
+		return ErrInvalid
+	}
+	pos := encPos{file: parts[2]}
+	if pos.seq, err = strconv.ParseUint(parts[3], 10, 64); err != nil {
+		return ErrInvalid
+	}
+	if pos.part, err = strconv.ParseUint(parts[4], 10, 64); err != nil {
+		return ErrInvalid
+	}
+	aead := er.db.enc.keys[parts[1]]
+	if aead == nil {
+		return ErrEncryptionKey
+	}
+	if parts[1] != er.db.enc.id {
+		// the file must be rewritten with the encryption key.
+		er.db.rekey = true
+	}
+	data := []byte(parts[5])
+	if len(data) < aead.NonceSize() {
+		return ErrInvalid
+	}
+	nonce := data[:aead.NonceSize()]
+	plain, err := aead.Open(data[aead.NonceSize():aead.NonceSize()],
+		nonce, data[aead.NonceSize():], pos.aad())
+	if err != nil {
+		return ErrChecksum
+	}
+	if !pos.follows(er.pos) {
+		// the record is authentic but out of place.
+		return ErrChecksum
+	}
+	er.pos = pos
+	er.plain = plain
+	er.raw += size
+	er.total += int64(len(plain))
+	er.ends = append(er.ends, [2]int64{er.total, er.raw})
+	return nil
+}
+
+// offset returns the position in the file of the end of the last record
+// that ends at or before a position in the decrypted data. Only the whole
+// records that were loaded are kept when loading fails part way.
+func (er *encReader) offset(n int64) int64 {
+	var off int64
+	for _, end := range er.ends {
+		if end[0] > n {
+			break
+		}
+		off = end[1]
+	}
+	return off
+}
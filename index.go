@@ -2,6 +2,7 @@ package buntdb
 
 import (
 	"errors"
+	"fmt"
 	"sort"
 	"strconv"
 	"strings"
@@ -137,9 +138,12 @@ type IndexOptions struct {
 // less function to handle the content format and comparison.
 // There are some default less function that can be used such as
 // IndexString, IndexBinary, etc.
+//
+// The index is not written to the database file. Use CreateIndexNamed for an
+// index that is.
 func (tx *Tx) CreateIndex(name, pattern string,
 	less ...func(a, b string) bool) error {
-	return tx.createIndex(name, pattern, less, nil, nil)
+	return tx.createIndex(name, pattern, less, nil, nil, nil)
 }
 
 // CreateIndexOptions is the same as CreateIndex except that it allows
@@ -147,7 +151,37 @@ func (tx *Tx) CreateIndex(name, pattern string,
 func (tx *Tx) CreateIndexOptions(name, pattern string,
 	opts *IndexOptions,
 	less ...func(a, b string) bool) error {
-	return tx.createIndex(name, pattern, less, nil, opts)
+	return tx.createIndex(name, pattern, less, nil, nil, opts)
+}
+
+// CreateIndexNamed is the same as CreateIndexOptions except that the less
+// functions are provided by their names, which allows for the index to be
+// written to the database file and created again when the file is loaded.
+//
+// A name is one of "string", "binary", "int", "uint", and "float" for the
+// built-in functions, "json:<path>" and "jsoncs:<path>" for IndexJSON and
+// IndexJSONCaseSensitive, a name in Options.Comparators, or any of these
+// prefixed with "desc:" for Desc. ErrUnknownFunc is returned for any other
+// name, and ErrInvalid when there are no names.
+func (tx *Tx) CreateIndexNamed(name, pattern string, opts *IndexOptions,
+	less ...string) error {
+	if tx.db == nil {
+		return ErrTxClosed
+	} else if !tx.writable {
+		return ErrTxNotWritable
+	}
+	if len(less) == 0 {
+		return ErrInvalid
+	}
+	lessers := make([]func(a, b string) bool, len(less))
+	for i, fname := range less {
+		fn, ok := tx.db.lessFunc(fname)
+		if !ok {
+			return fmt.Errorf("%w: %q", ErrUnknownFunc, fname)
+		}
+		lessers[i] = fn
+	}
+	return tx.createIndex(name, pattern, lessers, nil, less, opts)
 }
 
 // CreateSpatialIndex builds a new index and populates it with items.
@@ -164,9 +198,12 @@ func (tx *Tx) CreateIndexOptions(name, pattern string,
 // Thus min[0] must be less-than-or-equal-to max[0].
 // The IndexRect is a default function that can be used for the rect
 // parameter.
+//
+// The index is not written to the database file. Use CreateSpatialIndexNamed
+// for an index that is.
 func (tx *Tx) CreateSpatialIndex(name, pattern string,
 	rect func(item string) (min, max []float64)) error {
-	return tx.createIndex(name, pattern, nil, rect, nil)
+	return tx.createIndex(name, pattern, nil, rect, nil, nil)
 }
 
 // CreateSpatialIndexOptions is the same as CreateSpatialIndex except that
@@ -174,13 +211,34 @@ func (tx *Tx) CreateSpatialIndex(name, pattern string,
 func (tx *Tx) CreateSpatialIndexOptions(name, pattern string,
 	opts *IndexOptions,
 	rect func(item string) (min, max []float64)) error {
-	return tx.createIndex(name, pattern, nil, rect, nil)
+	return tx.createIndex(name, pattern, nil, rect, nil, nil)
 }
 
-// createIndex is called by CreateIndex() and CreateSpatialIndex()
+// CreateSpatialIndexNamed is the same as CreateSpatialIndexOptions except
+// that the rect function is provided by its name, which allows for the index
+// to be written to the database file and created again when the file is
+// loaded. The name is "rect" for IndexRect, or a name in Options.Rects.
+// ErrUnknownFunc is returned for any other name.
+func (tx *Tx) CreateSpatialIndexNamed(name, pattern string,
+	opts *IndexOptions, rect string) error {
+	if tx.db == nil {
+		return ErrTxClosed
+	} else if !tx.writable {
+		return ErrTxNotWritable
+	}
+	fn, ok := tx.db.rectFunc(rect)
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrUnknownFunc, rect)
+	}
+	return tx.createIndex(name, pattern, nil, fn, []string{rect}, opts)
+}
+
+// createIndex is called by CreateIndex() and CreateSpatialIndex(). The funcs
+// are the names of the functions of an index that is written to the file.
 func (tx *Tx) createIndex(name string, pattern string,
 	lessers []func(a, b string) bool,
 	rect func(item string) (min, max []float64),
+	funcs []string,
 	opts *IndexOptions,
 ) error {
 	if tx.db == nil {
@@ -189,6 +247,8 @@ func (tx *Tx) createIndex(name string, pattern string,
 		return ErrTxNotWritable
 	} else if tx.wc.itercount > 0 {
 		return ErrTxIterating
+	} else if tx.optimistic() {
+		return ErrInvalidOperation
 	}
 	if name == "" {
 		// cannot create an index without a name.
@@ -201,27 +261,7 @@ func (tx *Tx) createIndex(name string, pattern string,
 		return ErrIndexExists
 	}
 	// genreate a less function
-	var less func(a, b string) bool
-	switch len(lessers) {
-	default:
-		// multiple less functions specified.
-		// create a compound less function.
-		less = func(a, b string) bool {
-			for i := 0; i < len(lessers)-1; i++ {
-				if lessers[i](a, b) {
-					return true
-				}
-				if lessers[i](b, a) {
-					return false
-				}
-			}
-			return lessers[len(lessers)-1](a, b)
-		}
-	case 0:
-		// no less function
-	case 1:
-		less = lessers[0]
-	}
+	less := compoundLess(lessers)
 	var sopts IndexOptions
 	if opts != nil {
 		sopts = *opts
@@ -237,10 +277,15 @@ func (tx *Tx) createIndex(name string, pattern string,
 		rect:    rect,
 		db:      tx.db,
 		opts:    sopts,
+		funcs:   funcs,
+		persist: funcs != nil,
 	}
 	idx.rebuild()
 	// save the index
 	tx.db.idxs[name] = idx
+	if idx.persist {
+		tx.addCommit(&commitItem{cmd: cmdIndex, key: name, idx: idx})
+	}
 	if tx.wc.rbkeys == nil {
 		// store the index in the rollback map.
 		if _, ok := tx.wc.rollbackIndexes[name]; !ok {
@@ -252,6 +297,123 @@ func (tx *Tx) createIndex(name string, pattern string,
 	return nil
 }
 
+// compoundLess returns a single less function for the provided less
+// functions. Multiple functions are evaluated in order until one of them
+// finds that the items are not equal.
+func compoundLess(lessers []func(a, b string) bool) func(a, b string) bool {
+	switch len(lessers) {
+	case 0:
+		// no less function
+		return nil
+	case 1:
+		return lessers[0]
+	}
+	// multiple less functions specified.
+	// create a compound less function.
+	return func(a, b string) bool {
+		for i := 0; i < len(lessers)-1; i++ {
+			if lessers[i](a, b) {
+				return true
+			}
+			if lessers[i](b, a) {
+				return false
+			}
+		}
+		return lessers[len(lessers)-1](a, b)
+	}
+}
+
+// loadIndex creates an index from a definition that was read from the aof
+// file. An existing index with the same name is replaced.
+func (db *DB) loadIndex(spatial bool, name, pattern, flags string,
+	funcs []string,
+) error {
+	idx := &index{
+		name:    name,
+		pattern: pattern,
+		db:      db,
+		funcs:   funcs,
+		persist: true,
+	}
+	switch flags {
+	case "":
+	case "ci":
+		idx.opts.CaseInsensitiveKeyMatching = true
+	default:
+		return ErrInvalid
+	}
+	if spatial {
+		if len(funcs) != 1 {
+			return ErrInvalid
+		}
+		rect, ok := db.rectFunc(funcs[0])
+		if !ok {
+			return fmt.Errorf("%w: unknown rect function %q", ErrInvalid,
+				funcs[0])
+		}
+		idx.rect = rect
+	} else {
+		lessers := make([]func(a, b string) bool, len(funcs))
+		for i, fname := range funcs {
+			less, ok := db.lessFunc(fname)
+			if !ok {
+				return fmt.Errorf("%w: unknown less function %q", ErrInvalid,
+					fname)
+			}
+			lessers[i] = less
+		}
+		idx.less = compoundLess(lessers)
+	}
+	idx.rebuild()
+	db.idxs[name] = idx
+	return nil
+}
+
+// writeIndexesTo writes the definitions of all persisted indexes.
+func (db *DB) writeIndexesTo(buf []byte) []byte {
+	names := make([]string, 0, len(db.idxs))
+	for name, idx := range db.idxs {
+		if idx.persist {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		buf = db.idxs[name].writeCreateTo(buf)
+	}
+	return buf
+}
+
+// writeCreateTo writes the index definition as a single INDEX or
+// SPATIALINDEX record.
+func (idx *index) writeCreateTo(buf []byte) []byte {
+	cmd := "index"
+	if idx.rect != nil {
+		cmd = "spatialindex"
+	}
+	var flags string
+	if idx.opts.CaseInsensitiveKeyMatching {
+		flags = "ci"
+	}
+	buf = appendArray(buf, 4+len(idx.funcs))
+	buf = appendBulkString(buf, cmd)
+	buf = appendBulkString(buf, idx.name)
+	buf = appendBulkString(buf, idx.pattern)
+	buf = appendBulkString(buf, flags)
+	for _, name := range idx.funcs {
+		buf = appendBulkString(buf, name)
+	}
+	return buf
+}
+
+// writeDropIndexTo writes a single DROPINDEX record.
+func writeDropIndexTo(buf []byte, name string) []byte {
+	buf = appendArray(buf, 2)
+	buf = appendBulkString(buf, "dropindex")
+	buf = appendBulkString(buf, name)
+	return buf
+}
+
 // DropIndex removes an index.
 func (tx *Tx) DropIndex(name string) error {
 	if tx.db == nil {
@@ -260,6 +422,8 @@ func (tx *Tx) DropIndex(name string) error {
 		return ErrTxNotWritable
 	} else if tx.wc.itercount > 0 {
 		return ErrTxIterating
+	} else if tx.optimistic() {
+		return ErrInvalidOperation
 	}
 	if name == "" {
 		// cannot drop the default "keys" index
@@ -272,6 +436,9 @@ func (tx *Tx) DropIndex(name string) error {
 	// delete from the map.
 	// this is all that is needed to delete an index.
 	delete(tx.db.idxs, name)
+	if idx.persist {
+		tx.addCommit(&commitItem{cmd: cmdDropIndex, key: name})
+	}
 	if tx.wc.rbkeys == nil {
 		// store the index in the rollback map.
 		if _, ok := tx.wc.rollbackIndexes[name]; !ok {
@@ -288,8 +455,9 @@ func (tx *Tx) Indexes() ([]string, error) {
 	if tx.db == nil {
 		return nil, ErrTxClosed
 	}
-	names := make([]string, 0, len(tx.db.idxs))
-	for name := range tx.db.idxs {
+	idxs := tx.trees().idxs
+	names := make([]string, 0, len(idxs))
+	for name := range idxs {
 		names = append(names, name)
 	}
 	sort.Strings(names)
@@ -385,3 +553,45 @@ func IndexJSONCaseSensitive(path string) func(a, b string) bool {
 		return gjson.Get(a, path).Less(gjson.Get(b, path), true)
 	}
 }
+
+// builtinFuncs maps the names of the built-in index functions, as they are
+// written to the aof file, to the functions.
+var builtinFuncs = map[string]interface{}{
+	"string": IndexString,
+	"binary": IndexBinary,
+	"int":    IndexInt,
+	"uint":   IndexUint,
+	"float":  IndexFloat,
+	"rect":   IndexRect,
+}
+
+// lessFunc resolves the name of a less function. See Tx.CreateIndexNamed.
+func (db *DB) lessFunc(name string) (func(a, b string) bool, bool) {
+	if less, ok := db.opts.Comparators[name]; ok {
+		return less, true
+	}
+	switch {
+	case strings.HasPrefix(name, "json:"):
+		return IndexJSON(name[5:]), true
+	case strings.HasPrefix(name, "jsoncs:"):
+		return IndexJSONCaseSensitive(name[7:]), true
+	case strings.HasPrefix(name, "desc:"):
+		less, ok := db.lessFunc(name[5:])
+		if !ok {
+			return nil, false
+		}
+		return Desc(less), true
+	}
+	less, ok := builtinFuncs[name].(func(a, b string) bool)
+	return less, ok
+}
+
+// rectFunc resolves the name of a rect function.
+func (db *DB) rectFunc(name string) (func(item string) (min, max []float64),
+	bool) {
+	if rect, ok := db.opts.Rects[name]; ok {
+		return rect, true
+	}
+	rect, ok := builtinFuncs[name].(func(item string) (min, max []float64))
+	return rect, ok
+}
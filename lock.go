@@ -0,0 +1,33 @@
+package buntdb
+
+import "os"
+
+// openLocked opens the database file for reading and appending, and locks it
+// so that no other process can open it at the same time. The file is opened
+// again when it was replaced by the process that had it locked before.
+func openLocked(path string) (*os.File, error) {
+	for {
+		// hardcoding 0666 as the default mode.
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0666)
+		if err != nil {
+			return nil, err
+		}
+		if err := lockFile(f); err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+		pfi, err := os.Stat(path)
+		if err == nil && os.SameFile(fi, pfi) {
+			return f, nil
+		}
+		_ = f.Close()
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+}
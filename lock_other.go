@@ -0,0 +1,20 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !windows
+
+package buntdb
+
+import "os"
+
+// fileLocking is false because file locking is not supported on this
+// platform. Nothing stops two processes from opening the same database file,
+// which corrupts it when both write to it.
+const fileLocking = false
+
+// lockSeparate is true when the database file is locked through a separate
+// lock file.
+const lockSeparate = false
+
+// lockFile does not lock the file, because file locking is not supported on
+// this platform. See fileLocking.
+func lockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,27 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package buntdb
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileLocking is true when the database file is locked.
+const fileLocking = true
+
+// lockSeparate is true when the database file is locked through a separate
+// lock file. The database file is locked itself, and keeps the lock when a
+// Shrink replaces it.
+const lockSeparate = false
+
+// lockFile takes an exclusive advisory lock on the file, which is released
+// when the file is closed. ErrLocked is returned when the lock is held by
+// another open file.
+func lockFile(f *os.File) error {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return ErrLocked
+	}
+	return err
+}
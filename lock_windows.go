@@ -0,0 +1,42 @@
+//go:build windows
+
+package buntdb
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// fileLocking is true when the database file is locked.
+const fileLocking = true
+
+// lockSeparate is true when the database file is locked through a separate
+// lock file. A file cannot be renamed over the database file while it's open,
+// so the lock would be lost when a Shrink replaces it.
+const lockSeparate = true
+
+var procLockFileEx = syscall.NewLazyDLL("kernel32.dll").NewProc("LockFileEx")
+
+const (
+	lockfileFailImmediately = 0x1
+	lockfileExclusiveLock   = 0x2
+	errorLockViolation      = syscall.Errno(33)
+)
+
+// lockFile takes an exclusive lock on the first byte of the file with
+// LockFileEx, which is released when the file is closed. ErrLocked is
+// returned when the lock is held by another open file.
+func lockFile(f *os.File) error {
+	var ol syscall.Overlapped
+	r, _, err := procLockFileEx.Call(f.Fd(),
+		lockfileExclusiveLock|lockfileFailImmediately, 0, 1, 0,
+		uintptr(unsafe.Pointer(&ol)))
+	if r != 0 {
+		return nil
+	}
+	if err == errorLockViolation {
+		return ErrLocked
+	}
+	return err
+}
@@ -0,0 +1,254 @@
+package buntdb
+
+// BeginOptimistic opens a new optimistic read/write transaction.
+// Unlike a transaction that is opened with Begin(true), an optimistic
+// transaction does not wait for other read/write transactions, which allows
+// for many of them to run at the same time. It reads the version of the
+// database that was committed last before it began, and its changes are not
+// made to the database until it commits.
+//
+// Commit returns ErrConflict, without making any changes, when an item that
+// was read or written by the transaction has been changed by another
+// transaction that committed after it began. Iterating over keys counts as
+// reading every item in the range, and iterating over an index, or using
+// Len or DeleteAll, counts as reading every item in the index or database.
+//
+// Indexes cannot be created or dropped by an optimistic transaction.
+//
+// All transactions must be closed by calling Commit() or Rollback() when done.
+func (db *DB) BeginOptimistic() (*Tx, error) {
+	return db.begin(nil, true, true)
+}
+
+// UpdateOptimistic executes a function within a managed optimistic read/write
+// transaction. It's the same as Update, except that the function is executed
+// again in a new transaction for as long as the transaction conflicts with
+// another one. See BeginOptimistic.
+//
+// Executing a manual commit or rollback from inside the function will result
+// in a panic.
+func (db *DB) UpdateOptimistic(fn func(tx *Tx) error) error {
+	for {
+		err := db.managed(nil, true, true, fn)
+		if err != ErrConflict {
+			return err
+		}
+	}
+}
+
+// readSet is what an optimistic transaction has read and written, which is
+// checked for conflicts when it commits.
+type readSet struct {
+	keys   map[string]bool   // the keys of the items
+	ranges []keyRange        // the ranges of keys that were iterated over
+	idxs   map[string]*index // the indexes that were iterated over
+	all    bool              // every item in the database
+}
+
+// keyRange is an inclusive range of keys.
+type keyRange struct {
+	min, max string
+	nomax    bool // the range has no max
+}
+
+func newReadSet() *readSet {
+	return &readSet{
+		keys: make(map[string]bool),
+		idxs: make(map[string]*index),
+	}
+}
+
+// addKey adds a single key. The read set may be nil, which is a transaction
+// that is not optimistic.
+func (rs *readSet) addKey(key string) {
+	if rs != nil {
+		rs.keys[key] = true
+	}
+}
+
+// addRange adds the range of keys of a scan. See Tx.scan.
+func (rs *readSet) addRange(desc, gt, lt bool, start, stop string) {
+	if rs == nil {
+		return
+	}
+	r := keyRange{nomax: true}
+	switch {
+	case gt && lt && desc:
+		r = keyRange{min: stop, max: start}
+	case gt && lt:
+		r = keyRange{min: start, max: stop}
+	case gt:
+		r.min = start
+	case lt:
+		r = keyRange{max: start}
+	}
+	rs.ranges = append(rs.ranges, r)
+}
+
+// addIndex adds every item in the index.
+func (rs *readSet) addIndex(idx *index) {
+	if rs != nil {
+		rs.idxs[idx.name] = idx
+	}
+}
+
+// addAll adds every item in the database.
+func (rs *readSet) addAll() {
+	if rs != nil {
+		rs.all = true
+	}
+}
+
+// conflicts returns true when a commit changed anything in the read set.
+func (rs *readSet) conflicts(cl *commitLog) bool {
+	if rs.all || cl.all {
+		return true
+	}
+	for _, key := range cl.keys {
+		if rs.keys[key] {
+			return true
+		}
+		for _, r := range rs.ranges {
+			if key >= r.min && (r.nomax || key <= r.max) {
+				return true
+			}
+		}
+		for _, idx := range rs.idxs {
+			if idx.match(key) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// commitLog is the changes made by a commit, which are checked for conflicts
+// by the optimistic transactions that began before it.
+type commitLog struct {
+	ver  uint64   // the version published by the commit
+	keys []string // the keys of the items that were set or deleted
+	all  bool     // every item changed, such as by DeleteAll
+}
+
+func newCommitLog(ver uint64, changes []*commitItem) *commitLog {
+	cl := &commitLog{ver: ver}
+	for _, ci := range changes {
+		switch ci.cmd {
+		case cmdSet, cmdDel:
+			cl.keys = append(cl.keys, ci.key)
+		default:
+			// the index changes also change which items a scan of an
+			// index reads.
+			cl.all = true
+		}
+	}
+	return cl
+}
+
+// pin returns the current version for a read-only or an optimistic
+// transaction. A pinned version is not changed by later commits, see
+// publishRTree. The changes that are committed after the version of an
+// optimistic transaction are kept until it's unpinned.
+func (db *DB) pin(optimistic bool) *dbView {
+	db.vmu.Lock()
+	defer db.vmu.Unlock()
+	if db.view != nil {
+		db.view.refs++
+		if optimistic {
+			if db.active == nil {
+				db.active = make(map[uint64]int)
+			}
+			db.active[db.view.ver]++
+		}
+	}
+	return db.view
+}
+
+// unpin releases a version that was returned by pin, and drops the changes
+// that are no longer needed by any optimistic transaction.
+func (db *DB) unpin(view *dbView, optimistic bool) {
+	db.vmu.Lock()
+	defer db.vmu.Unlock()
+	view.refs--
+	if !optimistic {
+		return
+	}
+	db.active[view.ver]--
+	if db.active[view.ver] == 0 {
+		delete(db.active, view.ver)
+	}
+	if len(db.active) == 0 {
+		db.commits = nil
+		return
+	}
+	oldest := view.ver
+	for ver := range db.active {
+		if ver < oldest {
+			oldest = ver
+		}
+	}
+	i := 0
+	for i < len(db.commits) && db.commits[i].ver <= oldest {
+		i++
+	}
+	db.commits = db.commits[i:]
+}
+
+// private returns the trees of an optimistic transaction that its changes
+// are made to, which are a private copy of its version.
+func (tx *Tx) private() *dbView {
+	if tx.wc.priv == nil {
+		// Copying a tree changes the original, so copies of the same version
+		// are made one at a time.
+		tx.db.vmu.Lock()
+		tx.wc.priv = tx.view.copy()
+		tx.db.vmu.Unlock()
+	}
+	return tx.wc.priv
+}
+
+// apply checks an optimistic transaction for conflicts and makes its changes
+// to the database, after which it's committed just like a transaction that
+// was opened with Begin(true). The database is locked unless an error is
+// returned.
+func (tx *Tx) apply() error {
+	db := tx.db
+	if err := db.lockContext(tx.ctx); err != nil {
+		return err
+	}
+	if db.closed {
+		db.Unlock()
+		return ErrDatabaseClosed
+	}
+	// The commits are only added while the database is locked.
+	db.vmu.Lock()
+	commits := db.commits
+	db.vmu.Unlock()
+	for _, cl := range commits {
+		if cl.ver > tx.view.ver && tx.wc.reads.conflicts(cl) {
+			db.Unlock()
+			return ErrConflict
+		}
+	}
+	db.unpin(tx.view, true)
+	changes := tx.wc.commitItems
+	tx.view = nil
+	tx.wc = &txWriteContext{
+		rollbackItems:   make(map[string]*dbItem),
+		rollbackIndexes: make(map[string]*index),
+		seq:             db.seq + 1,
+	}
+	for _, ci := range changes {
+		switch ci.cmd {
+		case cmdSet:
+			tx.set(ci.item)
+		case cmdDel:
+			// An item that has expired in the meantime is not found, which
+			// is ok.
+			_, _ = tx.Delete(ci.key)
+		case cmdFlushDB:
+			_ = tx.DeleteAll()
+		}
+	}
+	return nil
+}
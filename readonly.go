@@ -0,0 +1,52 @@
+package buntdb
+
+// OpenReadOnly opens a database file without write access, such as a file
+// that another process writes to. See Options.ReadOnly.
+func OpenReadOnly(path string) (*DB, error) {
+	return OpenWithOptions(path, Options{ReadOnly: true})
+}
+
+// Refresh loads the records that another process appended to the file of a
+// read-only database since it was last loaded. The database is loaded again
+// from the start when the file was replaced, such as by a Shrink of the other
+// process. See Options.TailInterval.
+func (db *DB) Refresh() error {
+	if !db.opts.ReadOnly {
+		return ErrInvalidOperation
+	}
+	db.Lock()
+	defer db.Unlock()
+	if db.closed {
+		return ErrDatabaseClosed
+	}
+	if !db.persist {
+		return nil
+	}
+	var replaced bool
+	if r, ok := db.file.(reopener); ok {
+		var err error
+		if replaced, err = r.reopen(); err != nil {
+			return err
+		}
+	}
+	size, err := db.file.Size()
+	if err != nil {
+		return err
+	}
+	if replaced || size < db.tailpos {
+		// the file was replaced.
+		db.clear()
+		db.report.Lost = nil
+		db.tailpos = 0
+	}
+	db.tailpos, err = db.loadFrom(db.tailpos, size, storageModTime(db.file))
+	// the loaded records are visible even when the load failed part way.
+	db.publish(nil)
+	return err
+}
+
+// reopener is a storage that can find the data that another process wrote
+// to it. Its reopen returns true when the data was replaced.
+type reopener interface {
+	reopen() (bool, error)
+}
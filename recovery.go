@@ -0,0 +1,176 @@
+package buntdb
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strconv"
+)
+
+// RecoveryMode represents how a database file with corrupt data is loaded.
+type RecoveryMode int
+
+const (
+	// RecoverRefuse refuses to open a database file that has corrupt data.
+	// This is the default.
+	RecoverRefuse RecoveryMode = 0
+	// RecoverTruncate loads everything up to the last valid transaction
+	// prior to the corrupt data, and truncates the rest of the file.
+	RecoverTruncate RecoveryMode = 1
+	// RecoverSkip skips over corrupt data and continues loading at the next
+	// transaction in the file that is intact. When there is no next
+	// transaction the rest of the file is truncated. A transaction is only
+	// known to be intact by its checksum, so this should be used along with
+	// the Checksum option. Otherwise loading may continue at data in a value
+	// that looks like a transaction.
+	RecoverSkip RecoveryMode = 2
+)
+
+// RecoveryReport describes the data that was lost while loading the database
+// file.
+type RecoveryReport struct {
+	// Lost are the sections of the file that were not loaded, in the order
+	// that they appear in the file.
+	Lost []LostSection
+}
+
+// LostSection is a section of the database file that was not loaded.
+type LostSection struct {
+	// Offset is the position of the section in the file.
+	Offset int64
+	// Size is the number of bytes in the section.
+	Size int64
+	// Err is the reason that the section was not loaded, such as
+	// ErrChecksum, ErrInvalid, or io.ErrUnexpectedEOF for a transaction
+	// that was not completely written.
+	Err error
+	// Truncated is true when the section was removed from the file.
+	Truncated bool
+}
+
+// RecoveryReport returns a report of the data that was lost while opening
+// the database. An empty report means that the entire file was loaded.
+func (db *DB) RecoveryReport() RecoveryReport {
+	db.RLock()
+	defer db.RUnlock()
+	return RecoveryReport{Lost: append([]LostSection(nil), db.report.Lost...)}
+}
+
+// beginRecord starts a transaction in the aof file.
+const beginRecord = "*1\r\n$5\r\nbegin\r\n"
+
+// appendBegin writes a single BEGIN record.
+func appendBegin(buf []byte) []byte {
+	return append(buf, beginRecord...)
+}
+
+// appendCommit writes a single COMMIT record.
+func appendCommit(buf []byte) []byte {
+	return append(buf, "*1\r\n$6\r\ncommit\r\n"...)
+}
+
+// appendCommitChecksum writes a single COMMIT record with the checksum of the
+// records that were written since the BEGIN.
+func appendCommitChecksum(buf []byte, crc uint32) []byte {
+	buf = appendArray(buf, 2)
+	buf = appendBulkString(buf, "commit")
+	buf = appendBulkString(buf, strconv.FormatUint(uint64(crc), 16))
+	return buf
+}
+
+// findBegin returns the position of the first BEGIN record, or ENC record of
+// an encrypted file, at or after the provided offset, or -1 if there is none.
+func findBegin(rd io.ReaderAt, off, size int64) (int64, error) {
+	buf := make([]byte, 64*1024)
+	for off < size {
+		n := int64(len(buf))
+		if n > size-off {
+			n = size - off
+		}
+		if _, err := rd.ReadAt(buf[:n], off); err != nil && err != io.EOF {
+			return -1, err
+		}
+		i := bytes.Index(buf[:n], []byte(beginRecord))
+		if j := bytes.Index(buf[:n], []byte(encRecord)); j != -1 &&
+			(i == -1 || j < i) {
+			i = j
+		}
+		if i != -1 {
+			return off + int64(i), nil
+		}
+		if off+n == size {
+			break
+		}
+		// overlap the chunks by the size of the record, minus one byte.
+		off += n - int64(len(beginRecord)) + 1
+	}
+	return -1, nil
+}
+
+// findFrame returns the position of the first transaction at or after the
+// provided offset that is completely written and passes checkFrame, or -1 if
+// there is none. A BEGIN record may just as well be part of a value.
+func (db *DB) findFrame(off, size int64) (int64, error) {
+	for {
+		next, err := findBegin(db.file, off, size)
+		if err != nil || next == -1 {
+			return next, err
+		}
+		rd := io.NewSectionReader(db.file, next, size-next)
+		if db.checkFrame(bufio.NewReader(rd)) {
+			return next, nil
+		}
+		off = next + 1
+	}
+}
+
+// checkFrame returns true if the reader starts with a transaction whose
+// checksum matches, or one without a checksum when the Checksum option is
+// not set. An ENC record is checked by decrypting it instead.
+func (db *DB) checkFrame(r *bufio.Reader) bool {
+	if isEncrypted(r) {
+		// records may be missing before it, but not from another file.
+		pos := encPos{file: db.encpos.file, gap: true}
+		return db.enc != nil && newEncReader(db, r, pos).next() == nil
+	}
+	cr := &commandReader{
+		r:     r,
+		data:  make([]byte, 4096),
+		parts: make([]string, 0, 8),
+	}
+	for i := 0; ; i++ {
+		// nul control characters are ignored, like when loading.
+		c, err := r.ReadByte()
+		if err != nil {
+			return false
+		}
+		if c == 0 {
+			continue
+		}
+		if err := r.UnreadByte(); err != nil {
+			return false
+		}
+		crc := cr.crc
+		if _, err := cr.readCommand(); err != nil {
+			return false
+		}
+		parts := cr.parts
+		switch {
+		case len(parts) == 0:
+			return false
+		case i == 0:
+			if len(parts) != 1 || !isCommand(parts[0], "begin") {
+				return false
+			}
+			cr.crc = 0
+		case isCommand(parts[0], "begin"):
+			return false
+		case isCommand(parts[0], "commit"):
+			if len(parts) == 1 {
+				return !db.opts.Checksum
+			}
+			sum, err := strconv.ParseUint(parts[1], 16, 32)
+			return len(parts) == 2 && err == nil && uint32(sum) == crc
+		}
+	}
+}
@@ -49,11 +49,19 @@ func (tx *Tx) Nearby(index, bounds string,
 		return nil
 	}
 	// // wrap a rtree specific iterator around the user-defined iterator.
+	done := tx.done()
+	var err error
 	iter := func(item rtred.Item, dist float64) bool {
+		select {
+		case <-done:
+			err = tx.ctx.Err()
+			return false
+		default:
+		}
 		dbi := item.(*dbItem)
-		return iterator(dbi.key, dbi.val, dist)
+		return iterator(dbi.key, tx.db.value(dbi), dist)
 	}
-	idx := tx.db.idxs[index]
+	idx := tx.trees().idxs[index]
 	if idx == nil {
 		// index was not found. return error
 		return ErrNotFound
@@ -62,6 +70,7 @@ func (tx *Tx) Nearby(index, bounds string,
 		// not an r-tree index. just return nil
 		return nil
 	}
+	tx.reads().addIndex(idx)
 	// execute the nearby search
 	var min, max []float64
 	if idx.rect != nil {
@@ -69,7 +78,7 @@ func (tx *Tx) Nearby(index, bounds string,
 	}
 	// set the center param to false, which uses the box dist calc.
 	idx.rtr.KNN(&rect{min, max}, false, iter)
-	return nil
+	return err
 }
 
 // Intersects searches for rectangle items that intersect a target rect.
@@ -87,11 +96,19 @@ func (tx *Tx) Intersects(index, bounds string,
 		return nil
 	}
 	// wrap a rtree specific iterator around the user-defined iterator.
+	done := tx.done()
+	var err error
 	iter := func(item rtred.Item) bool {
+		select {
+		case <-done:
+			err = tx.ctx.Err()
+			return false
+		default:
+		}
 		dbi := item.(*dbItem)
-		return iterator(dbi.key, dbi.val)
+		return iterator(dbi.key, tx.db.value(dbi))
 	}
-	idx := tx.db.idxs[index]
+	idx := tx.trees().idxs[index]
 	if idx == nil {
 		// index was not found. return error
 		return ErrNotFound
@@ -100,11 +117,12 @@ func (tx *Tx) Intersects(index, bounds string,
 		// not an r-tree index. just return nil
 		return nil
 	}
+	tx.reads().addIndex(idx)
 	// execute the search
 	var min, max []float64
 	if idx.rect != nil {
 		min, max = idx.rect(bounds)
 	}
 	idx.rtr.Search(&rect{min, max}, iter)
-	return nil
+	return err
 }
@@ -0,0 +1,593 @@
+package buntdb
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The replication stream is made of RESP commands. The follower starts it
+// with the sequence of the last commit that it has, and the primary sends
+// the rest.
+//
+//	REPLICATE <seq>               follower: the last commit it has
+//	SYNC <seq>                    primary: a full copy of the database
+//	CHUNK <data>                  primary: the next part of the copy
+//	TX <seq> <latest> <records>   primary: the records of a single commit
+//	PING <latest>                 primary: sent every second when idle
+//
+// The records of a commit are the same records that are written to the file
+// of the primary. The full copy is a snapshot that is written by Save, which
+// is sent in chunks after the SYNC, and ends with an empty chunk. Both are
+// loaded by the follower just like a database file is, and the snapshot is
+// loaded and written to the file as it arrives. The latest is the sequence
+// of the last commit of the primary, which tells the follower how far behind
+// it is.
+
+// ReplicaStatus is the state of a replica that follows a primary.
+type ReplicaStatus struct {
+	// Connected is true while Follow is receiving from the primary.
+	Connected bool
+	// Seq is the sequence of the last commit that was applied.
+	Seq uint64
+	// PrimarySeq is the sequence of the last commit of the primary that is
+	// known to the replica.
+	PrimarySeq uint64
+	// Lag is the number of commits that have not been applied yet.
+	Lag uint64
+	// LastContact is when the primary was last heard from.
+	LastContact time.Time
+	// Resyncs is the number of full copies of the database that were
+	// received.
+	Resyncs int
+}
+
+// replicaState is the ReplicaStatus of a replica.
+type replicaState struct {
+	mu     sync.Mutex
+	status ReplicaStatus
+}
+
+// update records a message from the primary.
+func (rs *replicaState) update(seq, latest uint64, resync bool) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if seq != 0 {
+		rs.status.Seq = seq
+	}
+	if latest > rs.status.PrimarySeq || resync {
+		rs.status.PrimarySeq = latest
+	}
+	if resync {
+		rs.status.Resyncs++
+	}
+	rs.status.LastContact = time.Now()
+}
+
+// ReplicaStatus returns how far behind its primary the replica is.
+func (db *DB) ReplicaStatus() ReplicaStatus {
+	db.replica.mu.Lock()
+	defer db.replica.mu.Unlock()
+	status := db.replica.status
+	if status.PrimarySeq > status.Seq {
+		status.Lag = status.PrimarySeq - status.Seq
+	}
+	return status
+}
+
+// backlog keeps the records of the latest commits of a primary for its
+// followers.
+type backlog struct {
+	mu     sync.Mutex
+	frames []frame       // the commits, in order
+	size   int           // the number of bytes of the commits
+	max    int           // the size that the commits are trimmed to
+	after  uint64        // every commit after this sequence is kept
+	epoch  int           // changes when the followers must resync
+	wake   chan struct{} // closed when the backlog changes
+	closed bool          // the database was closed
+}
+
+// frame is the records of a single commit.
+type frame struct {
+	seq  uint64
+	data []byte
+}
+
+func newBacklog(seq uint64, max int) *backlog {
+	return &backlog{max: max, after: seq, wake: make(chan struct{})}
+}
+
+// broadcast wakes the followers that are waiting on the backlog.
+func (bl *backlog) broadcast() {
+	close(bl.wake)
+	bl.wake = make(chan struct{})
+}
+
+// add adds the records of a commit. The oldest commits are removed once the
+// backlog is too large, but the latest commit is always kept.
+func (bl *backlog) add(seq uint64, data []byte) {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	bl.frames = append(bl.frames, frame{seq, append([]byte(nil), data...)})
+	bl.size += len(data)
+	for bl.size > bl.max && len(bl.frames) > 1 {
+		bl.size -= len(bl.frames[0].data)
+		bl.after = bl.frames[0].seq
+		bl.frames[0] = frame{}
+		bl.frames = bl.frames[1:]
+	}
+	bl.broadcast()
+}
+
+// reset removes every commit, which makes the followers resync.
+func (bl *backlog) reset(seq uint64) {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	bl.frames, bl.size, bl.after = nil, 0, seq
+	bl.epoch++
+	bl.broadcast()
+}
+
+// close closes the backlog when the database is closed.
+func (bl *backlog) close() {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	bl.closed = true
+	bl.broadcast()
+}
+
+// since returns the commits after a sequence and a channel that is closed
+// when there are more. False is returned when the commits are no longer kept,
+// or the backlog was reset since the epoch.
+func (bl *backlog) since(seq uint64, epoch int) (frames []frame,
+	wake chan struct{}, ok bool, err error) {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	if bl.closed {
+		return nil, nil, false, ErrDatabaseClosed
+	}
+	last := bl.after
+	if len(bl.frames) > 0 {
+		last = bl.frames[len(bl.frames)-1].seq
+	}
+	if epoch != bl.epoch || seq < bl.after || seq > last {
+		return nil, nil, false, nil
+	}
+	i := sort.Search(len(bl.frames), func(i int) bool {
+		return bl.frames[i].seq > seq
+	})
+	frames = append([]frame(nil), bl.frames[i:]...)
+	return frames, bl.wake, true, nil
+}
+
+// startBacklog returns the backlog of the database, which is created by the
+// first follower.
+func (db *DB) startBacklog() (*backlog, int, error) {
+	db.Lock()
+	defer db.Unlock()
+	if db.closed {
+		return nil, 0, ErrDatabaseClosed
+	}
+	if db.backlog == nil {
+		max := db.opts.ReplicationBacklog
+		if max <= 0 {
+			max = 1024 * 1024
+		}
+		db.backlog = newBacklog(db.seq, max)
+	}
+	db.backlog.mu.Lock()
+	defer db.backlog.mu.Unlock()
+	return db.backlog, db.backlog.epoch, nil
+}
+
+// Replicate sends the commits of the database to a follower, which calls
+// Follow with the other end of the connection.
+//
+// The follower says which commit it has. The commits after it are sent when
+// they are still in the backlog, otherwise the follower is sent a full copy of
+// the database first. After that every commit is sent as soon as it has been
+// written. See Options.ReplicationBacklog.
+//
+// This returns when the context is done, the database is closed, or the
+// connection fails. When rw is an io.Closer it's closed once the context is
+// done, which stops a write that is waiting on the follower.
+func (db *DB) Replicate(ctx context.Context, rw io.ReadWriter) error {
+	stop := closeOnDone(ctx, rw)
+	defer stop()
+	cr := &commandReader{
+		r:     bufio.NewReader(rw),
+		data:  make([]byte, 64),
+		parts: make([]string, 0, 2),
+	}
+	if _, err := cr.readCommand(); err != nil {
+		return connErr(ctx, err)
+	}
+	if len(cr.parts) != 2 || !isCommand(cr.parts[0], "replicate") {
+		return ErrInvalid
+	}
+	seq, err := strconv.ParseUint(cr.parts[1], 10, 64)
+	if err != nil {
+		return ErrInvalid
+	}
+	bl, epoch, err := db.startBacklog()
+	if err != nil {
+		return err
+	}
+	wr := bufio.NewWriter(rw)
+	ping := time.NewTicker(time.Second)
+	defer ping.Stop()
+	var buf []byte
+	for {
+		frames, wake, ok, err := bl.since(seq, epoch)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			// the follower needs a full copy of the database.
+			if seq, epoch, err = db.writeSync(wr); err != nil {
+				return connErr(ctx, err)
+			}
+			continue
+		}
+		for _, f := range frames {
+			buf = appendArray(buf[:0], 4)
+			buf = appendBulkString(buf, "tx")
+			buf = appendBulkString(buf, strconv.FormatUint(f.seq, 10))
+			buf = appendBulkString(buf,
+				strconv.FormatUint(frames[len(frames)-1].seq, 10))
+			buf = appendBulkString(buf, string(f.data))
+			if _, err := wr.Write(buf); err != nil {
+				return connErr(ctx, err)
+			}
+			seq = f.seq
+		}
+		if err := wr.Flush(); err != nil {
+			return connErr(ctx, err)
+		}
+		select {
+		case <-wake:
+		case <-ping.C:
+			buf = appendArray(buf[:0], 2)
+			buf = appendBulkString(buf, "ping")
+			buf = appendBulkString(buf, strconv.FormatUint(seq, 10))
+			if _, err := wr.Write(buf); err != nil {
+				return connErr(ctx, err)
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// writeSync writes a full copy of the database for a follower, and returns
+// the sequence of the copy and the epoch of the backlog that it belongs to.
+func (db *DB) writeSync(wr io.Writer) (seq uint64, epoch int, err error) {
+	// the copy is of the version that matches the backlog.
+	db.RLock()
+	view := db.currentView()
+	header := db.writeHeaderTo(nil)
+	format := db.config.SnapshotFormat
+	db.backlog.mu.Lock()
+	epoch = db.backlog.epoch
+	db.backlog.mu.Unlock()
+	db.RUnlock()
+	if view == nil {
+		return 0, 0, ErrDatabaseClosed
+	}
+	buf := appendArray(nil, 2)
+	buf = appendBulkString(buf, "sync")
+	buf = appendBulkString(buf, strconv.FormatUint(view.seq, 10))
+	if _, err := wr.Write(buf); err != nil {
+		return 0, 0, err
+	}
+	cw := &chunkWriter{w: wr}
+	if err := saveView(cw, view, header, format, db.zip, nil); err != nil {
+		return 0, 0, err
+	}
+	// an empty chunk ends the copy.
+	if _, err := cw.Write(nil); err != nil {
+		return 0, 0, err
+	}
+	return view.seq, epoch, nil
+}
+
+// chunkWriter writes every Write as a CHUNK command.
+type chunkWriter struct {
+	w   io.Writer
+	buf []byte
+}
+
+func (cw *chunkWriter) Write(p []byte) (int, error) {
+	cw.buf = appendArray(cw.buf[:0], 2)
+	cw.buf = appendBulkString(cw.buf, "chunk")
+	cw.buf = append(cw.buf, '$')
+	cw.buf = strconv.AppendInt(cw.buf, int64(len(p)), 10)
+	cw.buf = append(cw.buf, '\r', '\n')
+	if _, err := cw.w.Write(cw.buf); err != nil {
+		return 0, err
+	}
+	if _, err := cw.w.Write(p); err != nil {
+		return 0, err
+	}
+	if _, err := cw.w.Write([]byte{'\r', '\n'}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// chunkReader reads the data of the CHUNK commands of a full copy, up to the
+// empty chunk that ends it. Every chunk is also written to w, when it's not
+// nil, before it's read.
+type chunkReader struct {
+	cr    *commandReader
+	w     io.Writer
+	chunk string // the data of the chunk that was not read yet
+	size  int64  // the bytes of all chunks
+	done  bool   // the empty chunk was read
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.chunk) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if _, err := r.cr.readCommand(); err != nil {
+			if err == io.EOF {
+				// the connection ended before the copy did.
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		parts := r.cr.parts
+		if len(parts) != 2 || !isCommand(parts[0], "chunk") {
+			return 0, ErrInvalid
+		}
+		if parts[1] == "" {
+			r.done = true
+			continue
+		}
+		if r.w != nil {
+			if _, err := io.WriteString(r.w, parts[1]); err != nil {
+				return 0, err
+			}
+		}
+		r.chunk = parts[1]
+		r.size += int64(len(parts[1]))
+	}
+	n := copy(p, r.chunk)
+	r.chunk = r.chunk[n:]
+	return n, nil
+}
+
+// Follow keeps a replica up to date with the primary on the other end of the
+// connection, which calls Replicate. The database must have been opened with
+// Options.Replica, and not with Options.ReadOnly.
+//
+// The replica is sent the commits after the last one that it has, or a full
+// copy of the database when the primary no longer has them. The commits are
+// written to the file of a replica that persists to disk, so that following
+// again after opening it resumes where it left off.
+//
+// This returns when the context is done, the database is closed, or the
+// connection fails, after which Follow can be called again with a new
+// connection. When rw is an io.Closer it's closed once the context is done.
+func (db *DB) Follow(ctx context.Context, rw io.ReadWriter) error {
+	if !db.opts.Replica || db.opts.ReadOnly {
+		return ErrInvalidOperation
+	}
+	db.RLock()
+	closed, seq := db.closed, db.seq
+	db.RUnlock()
+	if closed {
+		return ErrDatabaseClosed
+	}
+	stop := closeOnDone(ctx, rw)
+	defer stop()
+	buf := appendArray(nil, 2)
+	buf = appendBulkString(buf, "replicate")
+	buf = appendBulkString(buf, strconv.FormatUint(seq, 10))
+	if _, err := rw.Write(buf); err != nil {
+		return connErr(ctx, err)
+	}
+	db.replica.mu.Lock()
+	db.replica.status.Connected = true
+	db.replica.status.Seq = seq
+	db.replica.mu.Unlock()
+	defer func() {
+		db.replica.mu.Lock()
+		db.replica.status.Connected = false
+		db.replica.mu.Unlock()
+	}()
+	cr := &commandReader{
+		r:     bufio.NewReader(rw),
+		data:  make([]byte, 4096),
+		parts: make([]string, 0, 4),
+	}
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if _, err := cr.readCommand(); err != nil {
+			return connErr(ctx, err)
+		}
+		parts := cr.parts
+		if len(parts) < 2 {
+			return ErrInvalid
+		}
+		n, err := strconv.ParseUint(parts[1], 10, 64)
+		if err != nil {
+			return ErrInvalid
+		}
+		switch {
+		case isCommand(parts[0], "tx") && len(parts) == 4:
+			latest, err := strconv.ParseUint(parts[2], 10, 64)
+			if err != nil {
+				return ErrInvalid
+			}
+			if err := db.applyCommit(n, parts[3]); err != nil {
+				return err
+			}
+			db.replica.update(n, latest, false)
+		case isCommand(parts[0], "sync") && len(parts) == 2:
+			if err := db.applySync(n, cr); err != nil {
+				return connErr(ctx, err)
+			}
+			db.replica.update(n, n, true)
+		case isCommand(parts[0], "ping") && len(parts) == 2:
+			db.replica.update(0, n, false)
+		default:
+			return ErrInvalid
+		}
+	}
+}
+
+// applyCommit loads the records of a commit that was sent by the primary.
+func (db *DB) applyCommit(seq uint64, data string) error {
+	db.Lock()
+	defer db.Unlock()
+	if db.closed {
+		return ErrDatabaseClosed
+	}
+	if seq <= db.seq {
+		// the commit was applied already
+		return nil
+	}
+	if _, err := db.readLoad(strings.NewReader(data), time.Now()); err != nil {
+		return err
+	}
+	db.seq = seq
+	if db.persist {
+		n, err := db.file.Append(db.encrypt([]byte(data), seq))
+		if err != nil {
+			return err
+		}
+		db.flushes++
+		if db.config.SyncPolicy == Always || db.syncDue(n) {
+			if err := db.file.Sync(); err != nil {
+				return err
+			}
+		}
+	}
+	db.publish(nil)
+	if db.backlog != nil {
+		// the replica is also the primary of its own followers.
+		db.backlog.add(seq, []byte(data))
+	}
+	return nil
+}
+
+// applySync replaces the database with a full copy that is sent by the
+// primary, which is read from the chunks that follow the SYNC command. The
+// copy is loaded into a database of its own, without locking the database,
+// and replaces the items and the indexes once it's complete. The file of a
+// replica that persists to disk is replaced too, which excludes a Shrink.
+// The database is unchanged when the copy fails.
+func (db *DB) applySync(seq uint64, cr *commandReader) error {
+	db.Lock()
+	for db.shrinking && !db.closed {
+		// the file is replaced by one replacement at a time.
+		db.Unlock()
+		time.Sleep(time.Millisecond * 10)
+		db.Lock()
+	}
+	if db.closed {
+		db.Unlock()
+		return ErrDatabaseClosed
+	}
+	r := &chunkReader{cr: cr}
+	var f StorageReplacement
+	var w io.WriteCloser
+	var file string
+	if db.persist {
+		size, err := db.file.Size()
+		if err == nil {
+			f, err = db.file.Replace(size)
+		}
+		if err != nil {
+			db.Unlock()
+			return err
+		}
+		file = newFileID()
+		w = db.enc.writer(f, file, seq)
+		r.w = w
+		db.shrinking = true
+	}
+	loaded := &DB{opts: db.opts, config: db.config, zip: db.zip, enc: db.enc}
+	loaded.keys = btreeNew(lessCtx(nil))
+	loaded.exps = btreeNew(lessCtx(&exctx{db}))
+	loaded.idxs = make(map[string]*index)
+	db.Unlock()
+
+	_, err := loaded.readLoad(r, time.Now())
+	if err == nil && w != nil {
+		err = w.Close()
+	}
+	db.Lock()
+	defer db.Unlock()
+	if err == nil && db.closed {
+		err = ErrDatabaseClosed
+	}
+	if f != nil {
+		if err == nil {
+			err = f.Commit()
+		}
+		if err != nil {
+			_ = f.Abort()
+		}
+		db.shrinking = false
+	}
+	if err != nil {
+		return err
+	}
+	// the index definitions are part of the copy.
+	for _, idx := range loaded.idxs {
+		idx.db = db
+	}
+	db.keys, db.exps, db.idxs = loaded.keys, loaded.exps, loaded.idxs
+	db.seq = seq
+	if f != nil {
+		db.lastaofsz = int(r.size)
+		// the commits that follow are appended to the new file.
+		db.encpos = encPos{file: file}
+	}
+	// the items that expire are removed by the background manager.
+	db.wakeBackgroundManager()
+	db.publish([]*commitItem{{cmd: cmdFlushDB}})
+	if db.backlog != nil {
+		db.backlog.reset(seq)
+	}
+	return nil
+}
+
+// closeOnDone closes c, when it's an io.Closer, once the context is done.
+// The returned function stops waiting on the context.
+func closeOnDone(ctx context.Context, c interface{}) func() {
+	closer, ok := c.(io.Closer)
+	if !ok || ctx.Done() == nil {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = closer.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// connErr returns the error of the context when a connection failed because
+// the context is done.
+func connErr(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
@@ -0,0 +1,488 @@
+package buntdb
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A segmented database file is a directory of files, which together are the
+// data of the database:
+//
+//	base-00000005.aof     a snapshot of the data before segment 5
+//	segment-00000005.aof
+//	segment-00000006.aof  the active segment
+//	LOCK
+//
+// The records are appended to the active segment until it reaches the
+// segment size, and then to a new segment. A Shrink starts a new segment and
+// writes a new base of the data before it, after which the previous base and
+// segments are deleted. Only the active segment is ever appended to, which
+// allows for incremental backups that only copy the new files.
+const (
+	segmentPrefix = "segment-"
+	basePrefix    = "base-"
+	segmentExt    = ".aof"
+)
+
+// segmentedStorage is the Storage of a segmented database file.
+type segmentedStorage struct {
+	mu       sync.Mutex // guards the fields below
+	dir      string     // the directory of the files
+	max      int64      // the size of a segment that starts a new one
+	readonly bool       // the files were opened without write access
+	lock     *os.File   // locks the directory
+	base     uint64     // the number of the base, zero for no base
+	parts    []*segment // the base and the segments in order
+}
+
+// segment is a file of a segmentedStorage.
+type segment struct {
+	f    *os.File
+	num  uint64 // the number of the segment
+	base bool   // the file is the base
+	size int64  // the size of the file
+}
+
+func segmentName(prefix string, num uint64) string {
+	return fmt.Sprintf("%s%08d%s", prefix, num, segmentExt)
+}
+
+// parseSegmentName returns the number of a base or segment file name.
+func parseSegmentName(name, prefix string) (uint64, bool) {
+	if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, segmentExt) {
+		return 0, false
+	}
+	num, err := strconv.ParseUint(
+		name[len(prefix):len(name)-len(segmentExt)], 10, 64)
+	return num, err == nil && num > 0
+}
+
+// openSegmentedStorage opens the segmented database file in a directory. A
+// directory that is opened for writing is created when it does not exist, and
+// is locked, while a read-only directory must already exist.
+func openSegmentedStorage(dir string, max int64,
+	readonly bool) (*segmentedStorage, error) {
+	ss := &segmentedStorage{dir: dir, max: max, readonly: readonly}
+	if !readonly {
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			return nil, err
+		}
+		lock, err := openLocked(filepath.Join(dir, "LOCK"))
+		if err != nil {
+			return nil, err
+		}
+		ss.lock = lock
+	}
+	if err := ss.open(); err != nil {
+		_ = ss.Close()
+		return nil, err
+	}
+	return ss, nil
+}
+
+// scan returns the number of the latest base and the numbers of the
+// segments in the directory. Temporary files that were left over by a
+// Shrink that did not complete are deleted.
+func (ss *segmentedStorage) scan() (base uint64, segs []uint64, err error) {
+	ents, err := os.ReadDir(ss.dir)
+	if err != nil {
+		return 0, nil, err
+	}
+	for _, ent := range ents {
+		name := ent.Name()
+		if num, ok := parseSegmentName(name, basePrefix); ok {
+			if num > base {
+				base = num
+			}
+		} else if num, ok := parseSegmentName(name, segmentPrefix); ok {
+			segs = append(segs, num)
+		} else if strings.HasSuffix(name, ".tmp") && !ss.readonly {
+			_ = os.Remove(filepath.Join(ss.dir, name))
+		}
+	}
+	sort.Slice(segs, func(i, j int) bool { return segs[i] < segs[j] })
+	return base, segs, nil
+}
+
+// open opens the latest base and the segments after it. The files before
+// the base are deleted, which were left over by a Shrink that completed
+// before it could delete them.
+func (ss *segmentedStorage) open() error {
+	base, segs, err := ss.scan()
+	if err != nil {
+		return err
+	}
+	if !ss.readonly {
+		ss.remove(base)
+	}
+	ss.base, ss.parts = base, nil
+	if base != 0 {
+		if err := ss.openPart(segmentName(basePrefix, base), base, true); err != nil {
+			return err
+		}
+	}
+	next := base
+	if next == 0 {
+		next = 1
+	}
+	for _, num := range segs {
+		if num < base {
+			continue
+		}
+		if num != next {
+			// a segment is missing.
+			return ErrInvalid
+		}
+		if err := ss.openPart(segmentName(segmentPrefix, num), num, false); err != nil {
+			return err
+		}
+		next++
+	}
+	if ss.readonly || (len(ss.parts) > 0 && !ss.active().base) {
+		return nil
+	}
+	return ss.create(next)
+}
+
+// remove deletes the bases and the segments before a base.
+func (ss *segmentedStorage) remove(base uint64) {
+	ents, err := os.ReadDir(ss.dir)
+	if err != nil {
+		return
+	}
+	for _, ent := range ents {
+		name := ent.Name()
+		if num, ok := parseSegmentName(name, basePrefix); ok && num < base {
+			_ = os.Remove(filepath.Join(ss.dir, name))
+		} else if num, ok := parseSegmentName(name, segmentPrefix); ok &&
+			num < base {
+			_ = os.Remove(filepath.Join(ss.dir, name))
+		}
+	}
+}
+
+// openPart opens a file and adds it to the end of the parts.
+func (ss *segmentedStorage) openPart(name string, num uint64, base bool) error {
+	path := filepath.Join(ss.dir, name)
+	var f *os.File
+	var err error
+	if ss.readonly {
+		f, err = os.Open(path)
+	} else {
+		f, err = os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0666)
+	}
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	ss.parts = append(ss.parts, &segment{f: f, num: num, base: base,
+		size: fi.Size()})
+	return nil
+}
+
+// create creates a new active segment.
+func (ss *segmentedStorage) create(num uint64) error {
+	f, err := os.OpenFile(filepath.Join(ss.dir, segmentName(segmentPrefix, num)),
+		os.O_CREATE|os.O_TRUNC|os.O_RDWR|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	ss.parts = append(ss.parts, &segment{f: f, num: num})
+	return syncDir(ss.dir)
+}
+
+// active returns the segment that is appended to.
+func (ss *segmentedStorage) active() *segment {
+	return ss.parts[len(ss.parts)-1]
+}
+
+// roll syncs the active segment and starts a new one.
+func (ss *segmentedStorage) roll() error {
+	seg := ss.active()
+	if err := seg.f.Sync(); err != nil {
+		return err
+	}
+	num := seg.num + 1
+	if seg.base {
+		num = seg.num
+	}
+	return ss.create(num)
+}
+
+// size returns the size of all of the parts.
+func (ss *segmentedStorage) size() int64 {
+	var size int64
+	for _, seg := range ss.parts {
+		size += seg.size
+	}
+	return size
+}
+
+func (ss *segmentedStorage) ReadAt(p []byte, off int64) (int, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	var n int
+	var start int64
+	for _, seg := range ss.parts {
+		end := start + seg.size
+		if n < len(p) && off < end {
+			m := len(p) - n
+			if int64(m) > end-off {
+				m = int(end - off)
+			}
+			k, err := seg.f.ReadAt(p[n:n+m], off-start)
+			n += k
+			off += int64(k)
+			if err != nil {
+				return n, err
+			}
+		}
+		start = end
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Append writes to the active segment, or to a new segment once the active
+// segment has reached the segment size. A commit is never split between
+// segments.
+func (ss *segmentedStorage) Append(p []byte) (int, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.readonly {
+		return 0, ErrInvalidOperation
+	}
+	if seg := ss.active(); seg.size > 0 && seg.size+int64(len(p)) > ss.max {
+		if err := ss.roll(); err != nil {
+			return 0, err
+		}
+	}
+	seg := ss.active()
+	n, err := seg.f.Write(p)
+	seg.size += int64(n)
+	return n, err
+}
+
+// Sync syncs the active segment. The other segments were synced when the
+// next segment was started.
+func (ss *segmentedStorage) Sync() error {
+	ss.mu.Lock()
+	if len(ss.parts) == 0 {
+		// a read-only directory that has no files.
+		ss.mu.Unlock()
+		return nil
+	}
+	f := ss.active().f
+	ss.mu.Unlock()
+	return f.Sync()
+}
+
+// Truncate truncates the file that has the new end of the data, and deletes
+// the segments after it.
+func (ss *segmentedStorage) Truncate(size int64) error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.readonly {
+		return ErrInvalidOperation
+	}
+	var start int64
+	for i, seg := range ss.parts {
+		end := start + seg.size
+		if size > end {
+			start = end
+			continue
+		}
+		if err := seg.f.Truncate(size - start); err != nil {
+			return err
+		}
+		seg.size = size - start
+		for _, next := range ss.parts[i+1:] {
+			_ = next.f.Close()
+			err := os.Remove(filepath.Join(ss.dir,
+				segmentName(segmentPrefix, next.num)))
+			if err != nil {
+				return err
+			}
+		}
+		ss.parts = ss.parts[:i+1]
+		if seg.base {
+			// the base is never appended to.
+			return ss.create(seg.num)
+		}
+		return nil
+	}
+	return ErrInvalidOperation
+}
+
+func (ss *segmentedStorage) Size() (int64, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return ss.size(), nil
+}
+
+// Replace starts a new segment, and writes the new base of the data before
+// it to a temporary file. Only all of the data can be replaced.
+func (ss *segmentedStorage) Replace(size int64) (StorageReplacement, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.readonly || size != ss.size() {
+		return nil, ErrInvalidOperation
+	}
+	if ss.active().size > 0 {
+		if err := ss.roll(); err != nil {
+			return nil, err
+		}
+	}
+	num := ss.active().num
+	tmpname := filepath.Join(ss.dir, segmentName(basePrefix, num)+".tmp")
+	f, err := os.OpenFile(tmpname,
+		os.O_CREATE|os.O_TRUNC|os.O_RDWR|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, err
+	}
+	return &segmentReplacement{ss: ss, f: f, num: num, tmpname: tmpname}, nil
+}
+
+func (ss *segmentedStorage) Close() error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	var err error
+	for _, seg := range ss.parts {
+		if cerr := seg.f.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	ss.parts = nil
+	if ss.lock != nil {
+		if cerr := ss.lock.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// reopen opens the new segments that another process started, and returns
+// true when it opened the files again because the other process wrote a new
+// base. Only a read-only directory is reopened.
+func (ss *segmentedStorage) reopen() (bool, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	base, segs, err := ss.scan()
+	if err != nil {
+		return false, err
+	}
+	if base != ss.base {
+		for _, seg := range ss.parts {
+			_ = seg.f.Close()
+		}
+		return true, ss.open()
+	}
+	for _, seg := range ss.parts {
+		fi, err := seg.f.Stat()
+		if err != nil {
+			return false, err
+		}
+		seg.size = fi.Size()
+	}
+	next := base
+	if next == 0 {
+		next = 1
+	}
+	if len(ss.parts) > 0 && !ss.active().base {
+		next = ss.active().num + 1
+	}
+	for _, num := range segs {
+		if num < next {
+			continue
+		}
+		if num != next {
+			return false, ErrInvalid
+		}
+		if err := ss.openPart(segmentName(segmentPrefix, num), num, false); err != nil {
+			return false, err
+		}
+		next++
+	}
+	return false, nil
+}
+
+// segmentReplacement is the new base of a segmentedStorage.
+type segmentReplacement struct {
+	ss      *segmentedStorage
+	f       *os.File
+	num     uint64 // the number of the base
+	tmpname string
+	done    bool // the base is now the base of the storage
+}
+
+func (r *segmentReplacement) Write(p []byte) (int, error) {
+	return r.f.Write(p)
+}
+
+// Commit renames the temporary file to the base, and deletes the previous
+// base and the segments before the new base.
+func (r *segmentReplacement) Commit() error {
+	if err := r.f.Sync(); err != nil {
+		return err
+	}
+	fi, err := r.f.Stat()
+	if err != nil {
+		return err
+	}
+	ss := r.ss
+	if err := os.Rename(r.tmpname,
+		filepath.Join(ss.dir, segmentName(basePrefix, r.num))); err != nil {
+		return err
+	}
+	r.done = true
+	if err := syncDir(ss.dir); err != nil {
+		return err
+	}
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	parts := []*segment{{f: r.f, num: r.num, base: true, size: fi.Size()}}
+	for _, seg := range ss.parts {
+		if !seg.base && seg.num >= r.num {
+			parts = append(parts, seg)
+		} else {
+			_ = seg.f.Close()
+		}
+	}
+	ss.base, ss.parts = r.num, parts
+	// a crash before the files are deleted leaves files that are deleted
+	// when the directory is opened again.
+	ss.remove(r.num)
+	return nil
+}
+
+func (r *segmentReplacement) Abort() error {
+	if r.done {
+		return nil
+	}
+	_ = r.f.Close()
+	return os.RemoveAll(r.tmpname)
+}
+
+// syncDir makes the changes to the files of a directory durable. Not every
+// platform can sync a directory, in which case there is nothing to do.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	_ = d.Sync()
+	return nil
+}
@@ -0,0 +1,379 @@
+package buntdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"strings"
+	"time"
+)
+
+// The binary snapshot format is an alternative to the RESP commands that are
+// written by Shrink and Save. It's a single section at the start of the data
+// that looks like:
+//
+//	BUNTSNAP <version>
+//	'i' <uvarint len> <command>                      (index definitions)
+//	's' <flags> <uvarint len> <key> <uvarint len> <val> [<varint exat>] [<uvarint rev>] [<uvarint len> <codec>]
+//	...
+//	'z' <crc32c>
+//
+// The items are written in ascending key order, which allows for bulk loading
+// the keys tree. The checksum is a big-endian CRC-32C of every byte from the
+// magic up to and including the 'z'. Any RESP commands that follow the section
+// are loaded like a normal aof file.
+const (
+	snapshotMagic   = "BUNTSNAP"
+	snapshotVersion = 3 // version 1 has no revisions, version 2 no codecs
+)
+
+const (
+	snapRecordCommand = 'i' // an embedded RESP command
+	snapRecordItem    = 's' // a key/value item
+	snapRecordEnd     = 'z' // the end of the section
+)
+
+const (
+	snapFlagExpires = 1 << 0 // the item has an expiration
+	snapFlagRev     = 1 << 1 // the item has a revision
+	snapFlagCodec   = 1 << 2 // the value is compressed
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// SnapshotFormat represents the format of the data written by Shrink and
+// Save.
+type SnapshotFormat int
+
+const (
+	// RESPSnapshot writes the same RESP commands that are used by the aof
+	// file.
+	RESPSnapshot SnapshotFormat = 0
+	// BinarySnapshot writes a compact and checksummed binary format that is
+	// much faster to load than RESP.
+	BinarySnapshot SnapshotFormat = 1
+)
+
+// snapshotWriter writes a binary snapshot section to a writer.
+type snapshotWriter struct {
+	wr  io.Writer
+	buf []byte
+	crc uint32
+	zip *compression // compresses the values, may be nil
+}
+
+// newSnapshotWriter returns a snapshotWriter that has the header buffered.
+func newSnapshotWriter(wr io.Writer, zip *compression) *snapshotWriter {
+	sw := &snapshotWriter{wr: wr, zip: zip}
+	sw.buf = append(sw.buf, snapshotMagic...)
+	sw.buf = append(sw.buf, snapshotVersion)
+	return sw
+}
+
+// writeCommands buffers RESP commands as embedded command records.
+func (sw *snapshotWriter) writeCommands(cmds []byte) {
+	for len(cmds) > 0 {
+		n := respCommandSize(cmds)
+		sw.buf = append(sw.buf, snapRecordCommand)
+		sw.buf = appendUvarint(sw.buf, uint64(n))
+		sw.buf = append(sw.buf, cmds[:n]...)
+		cmds = cmds[n:]
+	}
+}
+
+// writeItem buffers an item record.
+func (sw *snapshotWriter) writeItem(dbi *dbItem) {
+	var flags byte
+	if dbi.opts != nil && dbi.opts.ex {
+		flags |= snapFlagExpires
+	}
+	if dbi.rev != 0 {
+		flags |= snapFlagRev
+	}
+	val, codec := dbi.val, ""
+	if sw.zip != nil {
+		val, codec = sw.zip.encode(dbi)
+	}
+	if codec != "" {
+		flags |= snapFlagCodec
+	}
+	sw.buf = append(sw.buf, snapRecordItem, flags)
+	sw.buf = appendUvarint(sw.buf, uint64(len(dbi.key)))
+	sw.buf = append(sw.buf, dbi.key...)
+	sw.buf = appendUvarint(sw.buf, uint64(len(val)))
+	sw.buf = append(sw.buf, val...)
+	if flags&snapFlagExpires != 0 {
+		sw.buf = appendVarint(sw.buf, dbi.opts.exat.UnixNano())
+	}
+	if flags&snapFlagRev != 0 {
+		sw.buf = appendUvarint(sw.buf, dbi.rev)
+	}
+	if flags&snapFlagCodec != 0 {
+		sw.buf = appendUvarint(sw.buf, uint64(len(codec)))
+		sw.buf = append(sw.buf, codec...)
+	}
+}
+
+// flush writes the buffered records.
+func (sw *snapshotWriter) flush() error {
+	if len(sw.buf) == 0 {
+		return nil
+	}
+	sw.crc = crc32.Update(sw.crc, crc32c, sw.buf)
+	if _, err := sw.wr.Write(sw.buf); err != nil {
+		return err
+	}
+	sw.buf = sw.buf[:0]
+	return nil
+}
+
+// close writes the end record, the checksum, and any buffered records.
+func (sw *snapshotWriter) close() error {
+	sw.buf = append(sw.buf, snapRecordEnd)
+	crc := crc32.Update(sw.crc, crc32c, sw.buf)
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc)
+	sw.buf = append(sw.buf, sum[:]...)
+	_, err := sw.wr.Write(sw.buf)
+	sw.buf = sw.buf[:0]
+	return err
+}
+
+func appendUvarint(buf []byte, x uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], x)
+	return append(buf, tmp[:n]...)
+}
+
+func appendVarint(buf []byte, x int64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(tmp[:], x)
+	return append(buf, tmp[:n]...)
+}
+
+// respCommandSize returns the size of the first RESP command in a buffer
+// that was produced by appendArray and appendBulkString.
+func respCommandSize(buf []byte) int {
+	var i, count int
+	for i = 1; buf[i] != '\r'; i++ {
+		count = count*10 + int(buf[i]-'0')
+	}
+	i += 2
+	for ; count > 0; count-- {
+		var n int
+		j := i + 1
+		for ; buf[j] != '\r'; j++ {
+			n = n*10 + int(buf[j]-'0')
+		}
+		i = j + 2 + n + 2
+	}
+	return i
+}
+
+// snapshotReader reads a binary snapshot section while computing the
+// checksum of the bytes that were read.
+type snapshotReader struct {
+	r   *bufio.Reader
+	crc uint32
+	n   int64
+	buf []byte
+	one [1]byte
+}
+
+func (sr *snapshotReader) read(n int) ([]byte, error) {
+	buf := sr.buf[:0]
+	for len(buf) < n {
+		// grow the buffer in chunks so that a corrupt length cannot cause
+		// an enormous allocation before the end of the data is reached.
+		m := n - len(buf)
+		if m > 1024*1024 {
+			m = 1024 * 1024
+		}
+		if cap(buf) < len(buf)+m {
+			nbuf := make([]byte, len(buf), len(buf)+m)
+			copy(nbuf, buf)
+			buf = nbuf
+		}
+		if _, err := io.ReadFull(sr.r, buf[len(buf):len(buf)+m]); err != nil {
+			return nil, err
+		}
+		buf = buf[:len(buf)+m]
+	}
+	sr.buf = buf
+	sr.crc = crc32.Update(sr.crc, crc32c, buf)
+	sr.n += int64(n)
+	return buf, nil
+}
+
+func (sr *snapshotReader) readByte() (byte, error) {
+	c, err := sr.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	sr.one[0] = c
+	sr.crc = crc32.Update(sr.crc, crc32c, sr.one[:])
+	sr.n++
+	return c, nil
+}
+
+func (sr *snapshotReader) readUvarint() (uint64, error) {
+	var x uint64
+	var s uint
+	for i := 0; i < binary.MaxVarintLen64; i++ {
+		c, err := sr.readByte()
+		if err != nil {
+			return 0, err
+		}
+		if c < 0x80 {
+			return x | uint64(c)<<s, nil
+		}
+		x |= uint64(c&0x7f) << s
+		s += 7
+	}
+	return 0, ErrInvalid
+}
+
+func (sr *snapshotReader) readVarint() (int64, error) {
+	ux, err := sr.readUvarint()
+	x := int64(ux >> 1)
+	if ux&1 != 0 {
+		x = ^x
+	}
+	return x, err
+}
+
+func (sr *snapshotReader) readString() (string, error) {
+	n, err := sr.readUvarint()
+	if err != nil {
+		return "", err
+	}
+	if n > uint64(maxInt) {
+		return "", ErrInvalid
+	}
+	buf, err := sr.read(int(n))
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+const maxInt = int(^uint(0) >> 1)
+
+// hasSnapshot returns true if the reader is positioned at the start of a
+// binary snapshot section.
+func hasSnapshot(r *bufio.Reader) bool {
+	magic, _ := r.Peek(len(snapshotMagic))
+	return string(magic) == snapshotMagic
+}
+
+// readSnapshot reads a binary snapshot section and loads the items into the
+// database. Nothing is loaded unless the checksum at the end of the section
+// matches. Returns the number of bytes read.
+func (db *DB) readSnapshot(r *bufio.Reader) (n int64, err error) {
+	defer func() {
+		// A snapshot is written in full before it's ever used, so unlike
+		// the RESP commands, a partial snapshot is not allowed.
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			err = ErrInvalid
+		}
+	}()
+	sr := &snapshotReader{r: r}
+	header, err := sr.read(len(snapshotMagic) + 1)
+	if err != nil {
+		return sr.n, err
+	}
+	if v := header[len(snapshotMagic)]; v < 1 || v > snapshotVersion {
+		return sr.n, ErrInvalid
+	}
+	now := time.Now()
+	var cmds []string
+	var items []*dbItem
+	for {
+		kind, err := sr.readByte()
+		if err != nil {
+			return sr.n, err
+		}
+		switch kind {
+		case snapRecordCommand:
+			cmd, err := sr.readString()
+			if err != nil {
+				return sr.n, err
+			}
+			cmds = append(cmds, cmd)
+		case snapRecordItem:
+			flags, err := sr.readByte()
+			if err != nil {
+				return sr.n, err
+			}
+			dbi := &dbItem{}
+			if dbi.key, err = sr.readString(); err != nil {
+				return sr.n, err
+			}
+			if dbi.val, err = sr.readString(); err != nil {
+				return sr.n, err
+			}
+			if flags&snapFlagExpires != 0 {
+				exat, err := sr.readVarint()
+				if err != nil {
+					return sr.n, err
+				}
+				dbi.opts = &dbItemOpts{ex: true, exat: time.Unix(0, exat)}
+			}
+			if flags&snapFlagRev != 0 {
+				if dbi.rev, err = sr.readUvarint(); err != nil {
+					return sr.n, err
+				}
+			}
+			var codec string
+			if flags&snapFlagCodec != 0 {
+				if codec, err = sr.readString(); err != nil {
+					return sr.n, err
+				}
+			}
+			if err := db.loadValue(dbi, codec); err != nil {
+				return sr.n, err
+			}
+			items = append(items, dbi)
+		case snapRecordEnd:
+			crc := sr.crc
+			sum, err := sr.read(4)
+			if err != nil {
+				return sr.n, err
+			}
+			if binary.BigEndian.Uint32(sum) != crc {
+				return sr.n, ErrInvalid
+			}
+			return sr.n, db.loadSnapshot(cmds, items, now)
+		default:
+			return sr.n, ErrInvalid
+		}
+	}
+}
+
+// loadSnapshot loads the commands and then the items of a snapshot section
+// whose checksum matched. Items without a revision get the next sequence.
+func (db *DB) loadSnapshot(cmds []string, items []*dbItem,
+	now time.Time) error {
+	for _, cmd := range cmds {
+		if _, err := db.readLoad(strings.NewReader(cmd), now); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				err = ErrInvalid
+			}
+			return err
+		}
+	}
+	for _, dbi := range items {
+		if dbi.rev == 0 {
+			db.seq++
+			dbi.rev = db.seq
+		} else if dbi.rev > db.seq {
+			db.seq = dbi.rev
+		}
+		if !dbi.expired() {
+			db.loadIntoDatabase(dbi)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,351 @@
+package buntdb
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Storage is where a database that persists to disk keeps its append-only
+// file. The default storage is a file at the path that the database was
+// opened with. See Options.Storage.
+//
+// The methods are called while the database is locked, except for Sync,
+// which is called at the same time as the others, and the writes to a
+// StorageReplacement, which happen at the same time as appends.
+type Storage interface {
+	// ReadAt reads the data at an offset, which is used to load the
+	// database.
+	io.ReaderAt
+	// Append writes data to the end of the storage.
+	Append(p []byte) (n int, err error)
+	// Sync makes the appended data durable.
+	Sync() error
+	// Truncate removes the data after the size. Appending continues at the
+	// new end.
+	Truncate(size int64) error
+	// Size returns the number of bytes of data.
+	Size() (int64, error)
+	// Replace begins replacing the first size bytes of the data, which is
+	// how the storage is shrunk. The data after it is kept.
+	Replace(size int64) (StorageReplacement, error)
+	// Close is called when the database is closed.
+	Close() error
+}
+
+// StorageReplacement is the new data of a Storage. The data is written to
+// it, and it's committed once it's complete.
+type StorageReplacement interface {
+	io.Writer
+	// Commit makes the written data the data of the storage, followed by
+	// the data after the replaced bytes, including the data that was
+	// appended since Replace. The data must be durable once this returns. A
+	// failure or a crash must leave either the previous data or the new
+	// data.
+	Commit() error
+	// Abort discards the written data. It's also called after Commit failed.
+	Abort() error
+}
+
+// fileStorage is the default Storage, which is a file on disk.
+type fileStorage struct {
+	mu       sync.Mutex // guards f, which is used by Sync at any time
+	f        *os.File   // the file
+	lock     *os.File   // locks the file when it's not locked itself
+	path     string     // the path of the file
+	readonly bool       // the file was opened without write access
+}
+
+// openFileStorage opens the file at the path. A file that is opened for
+// writing is locked, while a read-only file must already exist. A file that
+// cannot be locked itself is locked through a lock file next to it, which has
+// the path of the file with a ".lock" extension.
+func openFileStorage(path string, readonly bool) (*fileStorage, error) {
+	var f, lock *os.File
+	var err error
+	if readonly {
+		f, err = os.Open(path)
+	} else if lockSeparate {
+		lock, err = openLocked(path + ".lock")
+		if err == nil {
+			// hardcoding 0666 as the default mode.
+			f, err = os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND,
+				0666)
+			if err != nil {
+				_ = lock.Close()
+			}
+		}
+	} else {
+		f, err = openLocked(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &fileStorage{f: f, lock: lock, path: path, readonly: readonly}, nil
+}
+
+// file returns the current file, which changes when the file is replaced.
+func (fs *fileStorage) file() *os.File {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.f
+}
+
+// swap makes f the current file, and closes the previous file.
+func (fs *fileStorage) swap(f *os.File) error {
+	fs.mu.Lock()
+	prev := fs.f
+	fs.f = f
+	fs.mu.Unlock()
+	return prev.Close()
+}
+
+func (fs *fileStorage) ReadAt(p []byte, off int64) (int, error) {
+	return fs.file().ReadAt(p, off)
+}
+
+// Append writes to the end of the file, which was opened in append mode.
+func (fs *fileStorage) Append(p []byte) (int, error) {
+	return fs.file().Write(p)
+}
+
+func (fs *fileStorage) Sync() error {
+	return fs.file().Sync()
+}
+
+func (fs *fileStorage) Truncate(size int64) error {
+	return fs.file().Truncate(size)
+}
+
+func (fs *fileStorage) Size() (int64, error) {
+	fi, err := fs.file().Stat()
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// modTime returns when the file was last modified.
+func (fs *fileStorage) modTime() time.Time {
+	fi, err := fs.file().Stat()
+	if err != nil {
+		return time.Now()
+	}
+	return fi.ModTime()
+}
+
+// Replace writes the new data to a temporary file, which is renamed to the
+// path of the file when it's committed. The data after the replaced bytes is
+// copied to the temporary file first.
+func (fs *fileStorage) Replace(size int64) (StorageReplacement, error) {
+	if fs.readonly {
+		return nil, ErrInvalidOperation
+	}
+	tmpname := fs.path + ".tmp"
+	f, err := os.OpenFile(tmpname,
+		os.O_CREATE|os.O_TRUNC|os.O_RDWR|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, err
+	}
+	return &fileReplacement{fs: fs, f: f, tmpname: tmpname, size: size}, nil
+}
+
+func (fs *fileStorage) Close() error {
+	err := fs.file().Close()
+	if fs.lock != nil {
+		if cerr := fs.lock.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		// the lock file is only used on Windows, where it's not removed
+		// while another process has it open.
+		_ = os.Remove(fs.lock.Name())
+	}
+	return err
+}
+
+// reopen opens the file again when another process replaced it, such as by
+// a Shrink, and returns true when it did. Only a read-only file is reopened.
+func (fs *fileStorage) reopen() (bool, error) {
+	fi, err := fs.file().Stat()
+	if err != nil {
+		return false, err
+	}
+	pfi, err := os.Stat(fs.path)
+	if err != nil || os.SameFile(fi, pfi) {
+		return false, nil
+	}
+	f, err := os.Open(fs.path)
+	if err != nil {
+		return false, err
+	}
+	return true, fs.swap(f)
+}
+
+// fileReplacement is the temporary file of a fileStorage replacement.
+type fileReplacement struct {
+	fs      *fileStorage
+	f       *os.File
+	tmpname string
+	size    int64 // the number of bytes that are replaced
+	swapped bool  // the temporary file is now the file of the storage
+}
+
+func (r *fileReplacement) Write(p []byte) (int, error) {
+	return r.f.Write(p)
+}
+
+func (r *fileReplacement) Commit() error {
+	size, err := r.fs.Size()
+	if err != nil {
+		return err
+	}
+	tail := io.NewSectionReader(r.fs, r.size, size-r.size)
+	if _, err := io.Copy(r.f, tail); err != nil {
+		return err
+	}
+	if err := r.f.Sync(); err != nil {
+		return err
+	}
+	if fileLocking && !lockSeparate {
+		// The new file is locked before it replaces the old file, and
+		// becomes the database file without closing it, which keeps the
+		// database locked the whole time.
+		if err := lockFile(r.f); err != nil {
+			return err
+		}
+		if err := os.Rename(r.tmpname, r.fs.path); err != nil {
+			log.Panic().Caller().Err(err).Msg("Shrink failed during os.Rename")
+		}
+		r.swapped = true
+		return r.fs.swap(r.f)
+	}
+	// The files are closed before the rename, while the lock file, if any,
+	// keeps the database locked.
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	if err := r.fs.file().Close(); err != nil {
+		return err
+	}
+	// Any failures below here are really bad. So just panic.
+	if err := os.Rename(r.tmpname, r.fs.path); err != nil {
+		log.Panic().Caller().Err(err).Msg("Shrink failed during os.Rename")
+	}
+	r.swapped = true
+	f, err := os.OpenFile(r.fs.path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0666)
+	if err != nil {
+		log.Panic().Caller().Err(err).Msg("Shrink failed during os.OpenFile")
+	}
+	r.fs.mu.Lock()
+	r.fs.f = f
+	r.fs.mu.Unlock()
+	return nil
+}
+
+func (r *fileReplacement) Abort() error {
+	if r.swapped {
+		return nil
+	}
+	_ = r.f.Close()
+	return os.RemoveAll(r.tmpname)
+}
+
+// NewMemoryStorage returns a Storage that keeps the append-only file in
+// memory. Unlike a database that is opened with ":memory:", a database that
+// uses it writes and loads the file just like one that persists to disk. The
+// data is kept when the database is closed, which allows for opening another
+// database with the same storage.
+func NewMemoryStorage() Storage {
+	return &memStorage{}
+}
+
+// memStorage is a Storage in memory.
+type memStorage struct {
+	mu   sync.Mutex
+	data []byte
+}
+
+func (ms *memStorage) ReadAt(p []byte, off int64) (int, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if off >= int64(len(ms.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, ms.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (ms *memStorage) Append(p []byte) (int, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.data = append(ms.data, p...)
+	return len(p), nil
+}
+
+func (ms *memStorage) Sync() error {
+	return nil
+}
+
+func (ms *memStorage) Truncate(size int64) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if size < 0 || size > int64(len(ms.data)) {
+		return ErrInvalidOperation
+	}
+	ms.data = ms.data[:size]
+	return nil
+}
+
+func (ms *memStorage) Size() (int64, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return int64(len(ms.data)), nil
+}
+
+func (ms *memStorage) Replace(size int64) (StorageReplacement, error) {
+	return &memReplacement{ms: ms, size: size}, nil
+}
+
+func (ms *memStorage) Close() error {
+	return nil
+}
+
+// memReplacement is the new data of a memStorage.
+type memReplacement struct {
+	ms   *memStorage
+	size int64 // the number of bytes that are replaced
+	buf  bytes.Buffer
+}
+
+func (r *memReplacement) Write(p []byte) (int, error) {
+	return r.buf.Write(p)
+}
+
+func (r *memReplacement) Commit() error {
+	r.ms.mu.Lock()
+	defer r.ms.mu.Unlock()
+	data := append([]byte(nil), r.buf.Bytes()...)
+	r.ms.data = append(data, r.ms.data[r.size:]...)
+	return nil
+}
+
+func (r *memReplacement) Abort() error {
+	r.buf.Reset()
+	return nil
+}
+
+// storageModTime returns when the storage was last modified, which is used
+// for loading expirations that are relative to it.
+func storageModTime(s Storage) time.Time {
+	if fs, ok := s.(*fileStorage); ok {
+		return fs.modTime()
+	}
+	return time.Now()
+}
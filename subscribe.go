@@ -0,0 +1,217 @@
+package buntdb
+
+// EventType is the kind of change of an Event.
+type EventType int
+
+const (
+	// EventSet is an item that was set.
+	EventSet EventType = iota
+	// EventDelete is an item that was deleted.
+	EventDelete
+	// EventExpire is an item that was deleted after it had expired, which is
+	// usually done by the background manager.
+	EventExpire
+	// EventFlush is every item being deleted by DeleteAll. It has no key.
+	EventFlush
+)
+
+// Event is a single change made by a committed transaction.
+type Event struct {
+	// Type is the kind of change.
+	Type EventType
+	// Seq is the sequence of the commit, which is also the version of the
+	// items that were set by it.
+	Seq uint64
+	// Key is the key of the item.
+	Key string
+	// Value is the new value of the item, for EventSet.
+	Value string
+	// Previous is the value of the item before the change, when HasPrevious
+	// is true.
+	Previous string
+	// HasPrevious is true when the item existed and had not expired before
+	// the change. For EventExpire the Previous value is that of the expired
+	// item.
+	HasPrevious bool
+}
+
+// Subscription is a stream of the changes made by committed transactions.
+type Subscription struct {
+	// C receives the events in the order that they were committed. It's
+	// closed when the subscription is closed, after which Err returns the
+	// reason.
+	C <-chan Event
+
+	c       chan Event
+	db      *DB
+	pattern string
+	closed  bool
+	err     error
+}
+
+// Subscribe returns a subscription to the changes of the items whose keys
+// match the pattern, using the same matching as the patterns of indexes.
+// Flush events are received by every subscription. The events of a commit
+// are sent once the commit has succeeded, and has been synced according to
+// the SyncPolicy, which is after the events of the commits before it.
+//
+// The events are buffered up to Options.SubscriptionBuffer. A subscription
+// that is not received from fast enough is never waited on, instead it's
+// closed as soon as its buffer is full, and Err returns ErrSlowSubscriber.
+func (db *DB) Subscribe(pattern string) (*Subscription, error) {
+	size := db.opts.SubscriptionBuffer
+	if size <= 0 {
+		size = 1024
+	}
+	c := make(chan Event, size)
+	sub := &Subscription{C: c, c: c, db: db, pattern: pattern}
+	db.RLock()
+	defer db.RUnlock()
+	if db.closed {
+		return nil, ErrDatabaseClosed
+	}
+	db.submu.Lock()
+	db.subs = append(db.subs, sub)
+	db.submu.Unlock()
+	return sub, nil
+}
+
+// Close closes the subscription. Events that are still buffered can be
+// received from C.
+func (sub *Subscription) Close() error {
+	db := sub.db
+	db.submu.Lock()
+	defer db.submu.Unlock()
+	if sub.closed {
+		return nil
+	}
+	sub.stop(nil)
+	db.removeSubscriptions()
+	return nil
+}
+
+// Err returns the reason that the subscription was closed, which is nil when
+// it was closed by Close or is still open.
+func (sub *Subscription) Err() error {
+	sub.db.submu.Lock()
+	defer sub.db.submu.Unlock()
+	return sub.err
+}
+
+// stop closes the subscription for a reason. The caller must hold submu and
+// remove the subscription from the database.
+func (sub *Subscription) stop(err error) {
+	sub.closed = true
+	sub.err = err
+	close(sub.c)
+}
+
+// removeSubscriptions removes the closed subscriptions from the database.
+func (db *DB) removeSubscriptions() {
+	subs := db.subs[:0]
+	for _, sub := range db.subs {
+		if !sub.closed {
+			subs = append(subs, sub)
+		}
+	}
+	for i := len(subs); i < len(db.subs); i++ {
+		db.subs[i] = nil
+	}
+	db.subs = subs
+}
+
+// closeSubscriptions closes every subscription when the database is closed.
+func (db *DB) closeSubscriptions() {
+	db.submu.Lock()
+	defer db.submu.Unlock()
+	for _, sub := range db.subs {
+		sub.stop(ErrDatabaseClosed)
+	}
+	db.subs = nil
+	db.pending = nil
+}
+
+// events returns the events of the changes of a commit.
+func (db *DB) events(seq uint64, changes []*commitItem) []Event {
+	evs := make([]Event, 0, len(changes))
+	for _, ci := range changes {
+		ev := Event{Seq: seq, Key: ci.key}
+		switch ci.cmd {
+		case cmdSet:
+			ev.Type = EventSet
+			ev.Value = db.value(ci.item)
+		case cmdDel:
+			ev.Type = EventDelete
+			if ci.expired {
+				ev.Type = EventExpire
+			}
+		case cmdFlushDB:
+			ev.Type = EventFlush
+		default:
+			// index changes are not events
+			continue
+		}
+		if ci.prev != nil && (!ci.expired || ev.Type == EventExpire) {
+			ev.Previous, ev.HasPrevious = db.value(ci.prev), true
+		}
+		evs = append(evs, ev)
+	}
+	return evs
+}
+
+// pendingEvents are the events of a commit that are sent once the commit has
+// been synced.
+type pendingEvents struct {
+	ticket uint64 // the write that is synced, or zero
+	events []Event
+}
+
+// notify queues the events of a commit for the subscriptions. This is called
+// while the database is locked, which keeps the events in commit order. The
+// ticket is that of the sync that the commit waits for, or zero when it does
+// not wait for one. See deliver.
+func (db *DB) notify(seq uint64, changes []*commitItem, ticket uint64) {
+	db.submu.Lock()
+	defer db.submu.Unlock()
+	if len(db.subs) == 0 {
+		return
+	}
+	evs := db.events(seq, changes)
+	if len(evs) == 0 {
+		return
+	}
+	db.pending = append(db.pending, pendingEvents{ticket, evs})
+}
+
+// deliver sends the queued events of the commits that have been synced to
+// the subscriptions. A commit waits for the ones before it, so that the
+// events are sent in commit order. This is called by every commit once it's
+// synced.
+func (db *DB) deliver() {
+	db.submu.Lock()
+	defer db.submu.Unlock()
+	synced := db.gsync.done()
+	var slow bool
+	n := 0
+	for ; n < len(db.pending) && db.pending[n].ticket <= synced; n++ {
+		for _, ev := range db.pending[n].events {
+			for _, sub := range db.subs {
+				if sub.closed || (ev.Type != EventFlush &&
+					sub.pattern != "*" && !Match(ev.Key, sub.pattern)) {
+					continue
+				}
+				select {
+				case sub.c <- ev:
+				default:
+					sub.stop(ErrSlowSubscriber)
+					slow = true
+				}
+			}
+		}
+		db.pending[n] = pendingEvents{}
+	}
+	db.pending = db.pending[n:]
+	if slow {
+		db.removeSubscriptions()
+	}
+}
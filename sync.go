@@ -0,0 +1,83 @@
+package buntdb
+
+import "sync"
+
+// groupSync is the group commit that is used by the Always sync policy.
+// Every commit writes to the file while the database is locked, which keeps
+// the writes in order, and then waits for a sync of the file once the
+// database is unlocked. A single committer syncs the file for all of the
+// commits that were written up to that point, while the others wait for it,
+// so that concurrent commits share a sync instead of taking turns doing their
+// own.
+type groupSync struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	written uint64 // the number of writes to the file
+	synced  uint64 // the number of writes that have been synced
+	syncing bool   // a committer is syncing the file
+}
+
+func newGroupSync() *groupSync {
+	gs := &groupSync{}
+	gs.cond = sync.NewCond(&gs.mu)
+	return gs
+}
+
+// add adds a write to the file, and returns the ticket that is waited on.
+// This must be called after the write.
+func (gs *groupSync) add() uint64 {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	gs.written++
+	return gs.written
+}
+
+// wait waits until the write of the ticket has been synced. The file is
+// synced by the caller when no other committer is syncing it already.
+func (gs *groupSync) wait(ticket uint64, file Storage) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	for gs.synced < ticket {
+		if gs.syncing {
+			gs.cond.Wait()
+			continue
+		}
+		gs.syncing = true
+		written := gs.written
+		gs.mu.Unlock()
+		// A file that was swapped out by a shrink in the meantime has
+		// already been synced, so the error is ignored just like for a
+		// single sync.
+		_ = file.Sync()
+		gs.mu.Lock()
+		gs.syncing = false
+		if written > gs.synced {
+			gs.synced = written
+		}
+		gs.cond.Broadcast()
+	}
+}
+
+// done returns the ticket of the last write that has been synced.
+func (gs *groupSync) done() uint64 {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	return gs.synced
+}
+
+// syncDue adds a commit of n bytes to the writes that have not been synced,
+// and returns true when the SyncBytes or SyncCommits of the Periodic sync
+// policy has been reached. The writes are then expected to be synced.
+func (db *DB) syncDue(n int) bool {
+	if db.config.SyncPolicy != Periodic {
+		return false
+	}
+	db.unsynced += n
+	db.unsyncedTxs++
+	if (db.config.SyncBytes > 0 && db.unsynced >= db.config.SyncBytes) ||
+		(db.config.SyncCommits > 0 && db.unsyncedTxs >= db.config.SyncCommits) {
+		db.unsynced, db.unsyncedTxs = 0, 0
+		return true
+	}
+	return false
+}